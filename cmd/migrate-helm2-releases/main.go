@@ -0,0 +1,92 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+// migrate the helm2 releases of a runtime kept by Tiller into the helm3 release storage of the runtime
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"openpitrix.io/runtime-provider-helm3/pkg/service/runtime_provider"
+)
+
+var (
+	kubeconfig      = flag.String("kubeconfig", "", "kubeconfig file of the runtime")
+	runtimeId       = flag.String("runtime-id", "", "id of the runtime, to select the release storage in the provider options")
+	namespace       = flag.String("namespace", "", "namespace (zone) of the runtime")
+	tillerNamespace = flag.String("tiller-namespace", "kube-system", "namespace of Tiller")
+	tillerStorage   = flag.String("tiller-storage", runtime_provider.TillerStorageConfigMaps, "storage of Tiller, configmaps or secrets")
+	releases        = flag.String("release", "", "comma separated names of the releases to migrate, all releases of the namespace if empty")
+	dryRun          = flag.Bool("dry-run", false, "report the releases to migrate without migrating them")
+	cleanup         = flag.Bool("cleanup", false, "delete the Tiller records of the releases with all revisions migrated")
+)
+
+func fatal(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Parse()
+
+	if *kubeconfig == "" || *namespace == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	credentialContent, err := ioutil.ReadFile(*kubeconfig)
+	if err != nil {
+		fatal("read kubeconfig failed: %+v", err)
+	}
+
+	err = runtime_provider.LoadProviderOptions()
+	if err != nil {
+		fatal("load provider options failed: %+v", err)
+	}
+	storageOptions := runtime_provider.GetRuntimeOptions(*runtimeId).GetReleaseStorage()
+
+	cfg, err := runtime_provider.NewActionConfig(*runtimeId, *namespace, credentialContent, storageOptions)
+	if err != nil {
+		fatal("create helm3 release storage failed: %+v", err)
+	}
+
+	tiller, err := runtime_provider.NewTillerStorage(credentialContent, *tillerNamespace, *tillerStorage)
+	if err != nil {
+		fatal("create tiller storage failed: %+v", err)
+	}
+
+	migrator := runtime_provider.NewHelm2Migrator(tiller, cfg.Releases, *namespace)
+	migrator.DryRun = *dryRun
+	migrator.Cleanup = *cleanup
+
+	var names []string
+	if *releases != "" {
+		names = strings.Split(*releases, ",")
+	}
+	results, err := migrator.Run(names)
+	if err != nil {
+		fatal("list helm2 releases failed: %+v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tREVISION\tSTATUS\tRESULT\tCLEANED\tERROR")
+	failed := false
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%t\t%s\n",
+			result.Name, result.Version, result.Status, result.Result, result.Cleaned, result.Error)
+		if result.Error != "" {
+			failed = true
+		}
+	}
+	w.Flush()
+
+	if failed {
+		os.Exit(1)
+	}
+}
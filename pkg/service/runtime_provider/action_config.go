@@ -0,0 +1,89 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"sync"
+	"time"
+
+	"helm.sh/helm/pkg/action"
+)
+
+const DefaultActionConfigIdleTimeout = 30 * time.Minute
+
+var actionConfigs = NewActionConfigCache(DefaultActionConfigIdleTimeout)
+
+type actionConfigEntry struct {
+	// lock serializes building the configuration of the runtime, without blocking the other runtimes
+	lock              sync.Mutex
+	namespace         string
+	credentialContent string
+	storageOptions    ReleaseStorageOptions
+	config            *action.Configuration
+	lastUsed          time.Time
+}
+
+// ActionConfigCache keeps the helm action configuration of every runtime.
+// An entry is rebuilt when the runtime namespace, credential or release storage changes and evicted after being idle for idleTimeout.
+type ActionConfigCache struct {
+	lock        sync.Mutex
+	idleTimeout time.Duration
+	entries     map[string]*actionConfigEntry
+	newConfig   func(runtimeId, namespace string, credentialContent []byte, storageOptions ReleaseStorageOptions) (*action.Configuration, error)
+}
+
+func NewActionConfigCache(idleTimeout time.Duration) *ActionConfigCache {
+	return &ActionConfigCache{
+		idleTimeout: idleTimeout,
+		entries:     make(map[string]*actionConfigEntry),
+		newConfig:   NewActionConfig,
+	}
+}
+
+func (c *ActionConfigCache) Get(runtimeId, namespace, credentialContent string, storageOptions ReleaseStorageOptions) (*action.Configuration, error) {
+	entry := c.getEntry(runtimeId)
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if entry.config == nil || entry.namespace != namespace || entry.credentialContent != credentialContent || entry.storageOptions != storageOptions {
+		cfg, err := c.newConfig(runtimeId, namespace, []byte(credentialContent), storageOptions)
+		if err != nil {
+			entry.config = nil
+			return nil, err
+		}
+
+		entry.namespace = namespace
+		entry.credentialContent = credentialContent
+		entry.storageOptions = storageOptions
+		entry.config = cfg
+	}
+	return entry.config, nil
+}
+
+// getEntry returns the entry of the runtime, the configuration of which is built by Get out of the cache lock
+func (c *ActionConfigCache) getEntry(runtimeId string) *actionConfigEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	c.evictIdle(now)
+
+	entry, ok := c.entries[runtimeId]
+	if !ok {
+		entry = new(actionConfigEntry)
+		c.entries[runtimeId] = entry
+	}
+	entry.lastUsed = now
+	return entry
+}
+
+func (c *ActionConfigCache) evictIdle(now time.Time) {
+	for runtimeId, entry := range c.entries {
+		if now.Sub(entry.lastUsed) > c.idleTimeout {
+			delete(c.entries, runtimeId)
+		}
+	}
+}
@@ -18,32 +18,29 @@ package runtime_provider
 
 import (
 	"helm.sh/helm/pkg/action"
-	"helm.sh/helm/pkg/cli"
 	"helm.sh/helm/pkg/kube"
 	"helm.sh/helm/pkg/storage"
 	"helm.sh/helm/pkg/storage/driver"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
-	"log"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/util/homedir"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/logger"
 )
 
 var defaultCacheDir = filepath.Join(homedir.HomeDir(), ".kube", "http-cache")
-var (
-	settings   cli.EnvSettings
-	config     genericclioptions.RESTClientGetter
-	configOnce sync.Once
-)
 
 var _ genericclioptions.RESTClientGetter = &ConfigFlags{}
 
@@ -70,8 +67,10 @@ type ConfigFlags struct {
 	Password         *string
 	Timeout          *string
 
-	clientConfig clientcmd.ClientConfig
-	lock         sync.Mutex
+	clientConfig    clientcmd.ClientConfig
+	discoveryClient discovery.CachedDiscoveryInterface
+	lock            sync.Mutex
+	configLock      sync.Mutex
 	// If set to true, will use persistent client config and
 	// propagate the config to the places that need it, rather than
 	// loading the config multiple times
@@ -98,25 +97,25 @@ func (f *ConfigFlags) ToRawKubeConfigLoader() clientcmd.ClientConfig {
 }
 
 func (f *ConfigFlags) toRawKubeConfigLoader() clientcmd.ClientConfig {
-	var clientConfig clientcmd.ClientConfig
-
-	clientConfig, _ = clientcmd.NewClientConfigFromBytes(f.CredentialContent)
+	overrides := &clientcmd.ConfigOverrides{}
+	if f.Namespace != nil {
+		overrides.Context.Namespace = *f.Namespace
+	}
 
-	// we only have an interactive prompt when a password is allowed
-	//if f.Password == nil {
-	//	clientConfig = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
-	//} else {
-	//	clientConfig = clientcmd.NewInteractiveDeferredLoadingClientConfig(loadingRules, overrides, os.Stdin)
-	//}
+	config, err := clientcmd.Load(f.CredentialContent)
+	if err != nil {
+		// an empty client config returns an error as soon as it is used
+		config = clientcmdapi.NewConfig()
+	}
 
-	return clientConfig
+	return clientcmd.NewDefaultClientConfig(*config, overrides)
 }
 
 // toRawKubePersistentConfigLoader binds config flag values to config overrides
 // Returns a persistent clientConfig for propagation.
 func (f *ConfigFlags) toRawKubePersistentConfigLoader() clientcmd.ClientConfig {
-	f.lock.Lock()
-	defer f.lock.Unlock()
+	f.configLock.Lock()
+	defer f.configLock.Unlock()
 
 	if f.clientConfig == nil {
 		f.clientConfig = f.toRawKubeConfigLoader()
@@ -129,26 +128,38 @@ func (f *ConfigFlags) toRawKubePersistentConfigLoader() clientcmd.ClientConfig {
 // Expects the AddFlags method to have been called.
 // Returns a CachedDiscoveryInterface using a computed RESTConfig.
 func (f *ConfigFlags) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
-	//config, err := f.ToRESTConfig()
-	//if err != nil {
-	//	return nil, err
-	//}
-	//
-	//// The more groups you have, the more discovery requests you need to make.
-	//// given 25 groups (our groups + a few custom resources) with one-ish version each, discovery needs to make 50 requests
-	//// double it just so we don't end up here again for a while.  This config is only used for discovery.
-	//config.Burst = 100
-	//
-	//// retrieve a user-provided value for the "cache-dir"
-	//// defaulting to ~/.kube/http-cache if no user-value is given.
-	//httpCacheDir := defaultCacheDir
-	//if f.CacheDir != nil {
-	//	httpCacheDir = *f.CacheDir
-	//}
-	//
-	//discoveryCacheDir := computeDiscoverCacheDir(filepath.Join(homedir.HomeDir(), ".kube", "cache", "discovery"), config.Host)
-	//return diskcached.NewCachedDiscoveryClientForConfig(config, discoveryCacheDir, httpCacheDir, time.Duration(10*time.Minute))
-	return nil, nil
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.discoveryClient != nil {
+		return f.discoveryClient, nil
+	}
+
+	config, err := f.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// The more groups you have, the more discovery requests you need to make.
+	// given 25 groups (our groups + a few custom resources) with one-ish version each, discovery needs to make 50 requests
+	// double it just so we don't end up here again for a while.  This config is only used for discovery.
+	config.Burst = 100
+
+	// retrieve a user-provided value for the "cache-dir"
+	// defaulting to ~/.kube/http-cache if no user-value is given.
+	httpCacheDir := defaultCacheDir
+	if f.CacheDir != nil {
+		httpCacheDir = *f.CacheDir
+	}
+
+	discoveryCacheDir := computeDiscoverCacheDir(filepath.Join(homedir.HomeDir(), ".kube", "cache", "discovery"), config.Host)
+	discoveryClient, err := discovery.NewCachedDiscoveryClientForConfig(config, discoveryCacheDir, httpCacheDir, time.Duration(10*time.Minute))
+	if err != nil {
+		return nil, err
+	}
+
+	f.discoveryClient = discoveryClient
+	return f.discoveryClient, nil
 }
 
 // ToRESTMapper returns a mapper.
@@ -207,56 +218,57 @@ func computeDiscoverCacheDir(parentDir, host string) string {
 	return filepath.Join(parentDir, safeHost)
 }
 
-func kubeConfig(credentialContent []byte) genericclioptions.RESTClientGetter {
-	configOnce.Do(func() {
-		config = NewConfigFlags(false, credentialContent)
-	})
-	return config
+func actionLog(format string, v ...interface{}) {
+	logger.Debug(nil, format, v...)
 }
 
-func getNamespace(credentialContent []byte) string {
-	if ns, _, err := kubeConfig(credentialContent).ToRawKubeConfigLoader().Namespace(); err == nil {
-		return ns
+// NewActionConfig returns the helm action configuration working on namespace of the cluster in credentialContent,
+// the releases are kept in the storage described by storageOptions
+func NewActionConfig(runtimeId, namespace string, credentialContent []byte, storageOptions ReleaseStorageOptions) (*action.Configuration, error) {
+	_, err := clientcmd.Load(credentialContent)
+	if err != nil {
+		return nil, gerr.NewWithDetail(nil, gerr.InvalidArgument, err, gerr.ErrorCredentialIllegal, "kubeconfig")
 	}
-	return "default"
-}
 
-func NewActionConfig(allNamespaces bool, credentialContent []byte) *action.Configuration {
-	kc := kube.New(kubeConfig(credentialContent))
+	kubeConfig := NewConfigFlags(true, credentialContent)
+	kubeConfig.Namespace = stringptr(namespace)
+	kc := kube.New(kubeConfig)
 	//kc.Log = logf
 
 	clientset, err := kc.Factory.KubernetesClientSet()
 	if err != nil {
-		// TODO return error
-		log.Fatal(err)
-	}
-	var namespace string
-	if !allNamespaces {
-		namespace = getNamespace(credentialContent)
+		return nil, gerr.NewWithDetail(nil, gerr.InvalidArgument, err, gerr.ErrorCredentialIllegal, "kubeconfig")
 	}
 
 	var store *storage.Storage
-	switch os.Getenv("HELM_DRIVER") {
-	case "secret", "secrets", "":
+	switch storageOptions.Driver {
+	case "secret", ReleaseStorageSecrets, "":
 		d := driver.NewSecrets(clientset.CoreV1().Secrets(namespace))
-		//d.Log = logf
+		d.Log = actionLog
 		store = storage.Init(d)
-	case "configmap", "configmaps":
+	case "configmap", ReleaseStorageConfigMaps:
 		d := driver.NewConfigMaps(clientset.CoreV1().ConfigMaps(namespace))
-		//d.Log = logf
+		d.Log = actionLog
 		store = storage.Init(d)
-	case "memory":
+	case ReleaseStorageMemory:
 		d := driver.NewMemory()
 		store = storage.Init(d)
+	case ReleaseStorageSql:
+		db, err := openSqlDatabase(storageOptions.Dsn)
+		if err != nil {
+			return nil, gerr.NewWithDetail(nil, gerr.Internal, err, gerr.ErrorInternalError)
+		}
+		d := NewSqlDriver(db, runtimeId, namespace)
+		d.Log = actionLog
+		store = storage.Init(d)
 	default:
-		// Not sure what to do here.
-		panic("Unknown driver in HELM_DRIVER: " + os.Getenv("HELM_DRIVER"))
+		return nil, gerr.New(nil, gerr.InvalidArgument, gerr.ErrorUnsupportedParameterValue, "release_storage.driver", storageOptions.Driver)
 	}
 
 	return &action.Configuration{
-		RESTClientGetter: kubeConfig(credentialContent),
+		RESTClientGetter: kubeConfig,
 		KubeClient:       kc,
 		Releases:         store,
-		Log:              nil,
-	}
+		Log:              actionLog,
+	}, nil
 }
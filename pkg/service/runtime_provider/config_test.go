@@ -1,62 +1,282 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
 package runtime_provider
 
 import (
-	"context"
-	auth "github.com/deislabs/oras/pkg/auth/docker"
-	"helm.sh/helm/pkg/action"
-	"helm.sh/helm/pkg/chart"
-	"helm.sh/helm/pkg/chartutil"
-	"helm.sh/helm/pkg/registry"
-	"helm.sh/helm/pkg/release"
-	"path/filepath"
+	"os"
+	"sync"
 	"testing"
+	"time"
+
+	"google.golang.org/grpc/status"
+	"helm.sh/helm/pkg/action"
+	"helm.sh/helm/pkg/storage/driver"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
 )
 
+const testCredential = `apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: https://127.0.0.1:6443
+  name: test
+contexts:
+- context:
+    cluster: test
+    namespace: test
+    user: test
+  name: test
+current-context: test
+users:
+- name: test
+  user:
+    token: test
+`
+
+func assertCredentialIllegal(t *testing.T, err error) {
+	if err == nil {
+		t.Fatalf("expected error for malformed credential")
+	}
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != gerr.InvalidArgument {
+		t.Errorf("expected grpc error with code [%s], got [%+v]", gerr.InvalidArgument, err)
+	}
+}
+
+func TestAcitonConfig(t *testing.T) {
+	cfg, err := NewActionConfig("runtime-test", "test-zone", []byte(testCredential), ReleaseStorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Releases == nil || cfg.KubeClient == nil || cfg.RESTClientGetter == nil {
+		t.Errorf("expected action configuration to be complete, got [%+v]", cfg)
+	}
+}
+
+func TestActionConfigWithMalformedCredential(t *testing.T) {
+	for _, credential := range []string{
+		"",
+		"not a kubeconfig",
+		"apiVersion: v1\nkind: Config\nclusters: [",
+		"apiVersion: v1\nkind: Config\ncurrent-context: missing\n",
+	} {
+		_, err := NewActionConfig("runtime-test", "test-zone", []byte(credential), ReleaseStorageOptions{})
+		assertCredentialIllegal(t, err)
+	}
+
+	// the provider keeps serving other runtimes after a bad credential
+	_, err := NewActionConfig("runtime-test", "test-zone", []byte(testCredential), ReleaseStorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestActionConfigWithUnknownDriver(t *testing.T) {
+	_, err := NewActionConfig("runtime-test", "test-zone", []byte(testCredential), ReleaseStorageOptions{Driver: "unknown"})
+	if err == nil {
+		t.Fatalf("expected error for unknown driver")
+	}
+}
+
+func TestActionConfigReleaseStorage(t *testing.T) {
+	for driverName, expected := range map[string]string{
+		"":                       driver.SecretsDriverName,
+		ReleaseStorageSecrets:    driver.SecretsDriverName,
+		ReleaseStorageConfigMaps: driver.ConfigMapsDriverName,
+		ReleaseStorageMemory:     driver.MemoryDriverName,
+	} {
+		cfg, err := NewActionConfig("runtime-test", "test-zone", []byte(testCredential), ReleaseStorageOptions{Driver: driverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Releases.Name() != expected {
+			t.Errorf("expected driver [%s] for [%s], got [%s]", expected, driverName, cfg.Releases.Name())
+		}
+	}
+}
+
+func TestGetRuntimeOptions(t *testing.T) {
+	defer SetProviderOptions(new(ProviderOptions))
+
+	options, err := ParseProviderOptions([]byte(`
+release_storage:
+  driver: configmaps
+runtimes:
+  runtime-sql:
+    release_storage:
+      driver: sql
+      dsn: helm:password@tcp(127.0.0.1:3306)/helm
+  runtime-empty: {}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetProviderOptions(options)
+
+	for runtimeId, expected := range map[string]ReleaseStorageOptions{
+		"runtime-sql":     {Driver: ReleaseStorageSql, Dsn: "helm:password@tcp(127.0.0.1:3306)/helm"},
+		"runtime-empty":   {Driver: ReleaseStorageConfigMaps},
+		"runtime-unknown": {Driver: ReleaseStorageConfigMaps},
+	} {
+		storageOptions := GetRuntimeOptions(runtimeId).GetReleaseStorage()
+		if storageOptions != expected {
+			t.Errorf("expected release storage [%+v] of runtime [%s], got [%+v]", expected, runtimeId, storageOptions)
+		}
+	}
+}
+
+func TestGetReleaseStorageFromEnv(t *testing.T) {
+	helmDriver := os.Getenv("HELM_DRIVER")
+	defer os.Setenv("HELM_DRIVER", helmDriver)
+
+	os.Setenv("HELM_DRIVER", ReleaseStorageMemory)
+	storageOptions := GetRuntimeOptions("runtime-test").GetReleaseStorage()
+	if storageOptions.Driver != ReleaseStorageMemory {
+		t.Errorf("expected driver [%s], got [%s]", ReleaseStorageMemory, storageOptions.Driver)
+	}
+}
+
+func TestActionConfigCache(t *testing.T) {
+	cache := NewActionConfigCache(time.Minute)
+
+	_, err := cache.Get("runtime-test", "test-zone", "not a kubeconfig", ReleaseStorageOptions{})
+	assertCredentialIllegal(t, err)
 
-func Install() (*release.Release, error) {
-	cfg := newActionConfig(false)
-	credentialsFile := filepath.Join(settings.Home.Registry(), registry.CredentialsFileBasename)
-	client, err := auth.NewClient(credentialsFile)
+	cfg, err := cache.Get("runtime-test", "test-zone", testCredential, ReleaseStorageOptions{})
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	resolver, err := client.Resolver(context.Background())
+
+	cached, err := cache.Get("runtime-test", "test-zone", testCredential, ReleaseStorageOptions{})
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	if cached != cfg {
+		t.Errorf("expected action configuration to be cached")
+	}
+
+	moved, err := cache.Get("runtime-test", "other-zone", testCredential, ReleaseStorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == cfg {
+		t.Errorf("expected action configuration to be rebuilt when the zone changes")
 	}
-	cfg.RegistryClient = registry.NewClient(&registry.ClientOptions{
-		Debug: settings.Debug,
-		Out:   nil,
-		Authorizer: registry.Authorizer{
-			Client: client,
-		},
-		Resolver: registry.Resolver{
-			Resolver: resolver,
-		},
-		CacheRootDir: settings.Home.Registry(),
-	})
 
-	chartReq := &chart.Chart{}
+	memory, err := cache.Get("runtime-test", "other-zone", testCredential, ReleaseStorageOptions{Driver: ReleaseStorageMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory == moved {
+		t.Errorf("expected action configuration to be rebuilt when the release storage changes")
+	}
+}
 
-	rlsName := ""
-	installClient := action.NewInstall(cfg)
-	installClient.ReleaseName = rlsName
+func TestActionConfigNamespace(t *testing.T) {
+	cfg, err := NewActionConfig("runtime-test", "test-zone", []byte(testCredential), ReleaseStorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	validInstallableChart, err := chartutil.IsChartInstallable(chartReq)
-	if !validInstallableChart {
-		return nil, err
+	namespace, _, err := cfg.RESTClientGetter.(*ConfigFlags).ToRawKubeConfigLoader().Namespace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespace != "test-zone" {
+		t.Errorf("expected namespace [test-zone], got [%s]", namespace)
 	}
-	installClient.Namespace = getNamespace()
-	return installClient.Run(chartReq)
 }
 
-func UnInstall(rlsName string) (*release.UninstallReleaseResponse, error) {
-	cfg := newActionConfig(false)
+func TestActionConfigCacheConcurrency(t *testing.T) {
+	cache := NewActionConfigCache(time.Minute)
+
+	building := make(chan struct{})
+	unblock := make(chan struct{})
+	var lock sync.Mutex
+	builds := map[string]int{}
+	cache.newConfig = func(runtimeId, namespace string, credentialContent []byte, storageOptions ReleaseStorageOptions) (*action.Configuration, error) {
+		lock.Lock()
+		builds[runtimeId]++
+		lock.Unlock()
+		if runtimeId == "runtime-slow" {
+			close(building)
+			<-unblock
+		}
+		return new(action.Configuration), nil
+	}
+
+	var wg sync.WaitGroup
+	slowCfgs := make([]*action.Configuration, 3)
+	for i := range slowCfgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cfg, err := cache.Get("runtime-slow", "test-zone", testCredential, ReleaseStorageOptions{})
+			if err != nil {
+				t.Error(err)
+			}
+			slowCfgs[i] = cfg
+		}(i)
+	}
+	<-building
+
+	// a runtime slow to build does not block the others
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := cache.Get("runtime-fast", "test-zone", testCredential, ReleaseStorageOptions{})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected runtime not blocked by the runtime being built")
+	}
 
-	client := action.NewUninstall(cfg)
-	return client.Run(rlsName)
+	close(unblock)
+	wg.Wait()
+	if builds["runtime-slow"] != 1 {
+		t.Errorf("expected action configuration built once for concurrent calls, got [%d]", builds["runtime-slow"])
+	}
+	for _, cfg := range slowCfgs {
+		if cfg == nil || cfg != slowCfgs[0] {
+			t.Errorf("expected the same action configuration for concurrent calls, got [%+v]", slowCfgs)
+		}
+	}
 }
 
-func TestAcitonConfig(t *testing.T){
+func TestActionConfigCacheEviction(t *testing.T) {
+	cache := NewActionConfigCache(10 * time.Millisecond)
+	builds := 0
+	cache.newConfig = func(runtimeId, namespace string, credentialContent []byte, storageOptions ReleaseStorageOptions) (*action.Configuration, error) {
+		builds++
+		return new(action.Configuration), nil
+	}
+
+	cfg, err := cache.Get("runtime-idle", "test-zone", testCredential, ReleaseStorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
 
+	_, err = cache.Get("runtime-test", "test-zone", testCredential, ReleaseStorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.entries["runtime-idle"]; ok || len(cache.entries) != 1 {
+		t.Errorf("expected idle runtime evicted, got [%+v]", cache.entries)
+	}
+
+	rebuilt, err := cache.Get("runtime-idle", "test-zone", testCredential, ReleaseStorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt == cfg || builds != 3 {
+		t.Errorf("expected action configuration of evicted runtime rebuilt, got [%d] builds", builds)
+	}
 }
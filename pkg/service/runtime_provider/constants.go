@@ -19,3 +19,8 @@ const (
 	StatefulSetFlag = "-StatefulSet"
 	DaemonSetFlag   = "-DaemonSet"
 )
+
+const (
+	// ActionTestCluster runs the test hooks of the release after it is deployed
+	ActionTestCluster = "TestCluster"
+)
@@ -0,0 +1,117 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"helm.sh/helm/pkg/chart"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const (
+	// SkipCRDsKey skips installing the custom resource definitions in the crds/ directory of the chart
+	SkipCRDsKey = "SkipCRDs"
+
+	CustomResourceDefinitionGroup = "apiextensions.k8s.io"
+	CustomResourceDefinitionKind  = "CustomResourceDefinition"
+)
+
+// decodeManifest decodes the document by the scheme of client-go,
+// the kinds unknown to the scheme such as custom resources are decoded as unstructured
+func decodeManifest(doc []byte) (runtime.Object, *schema.GroupVersionKind, error) {
+	obj, groupVersionKind, err := scheme.Codecs.UniversalDeserializer().Decode(doc, nil, nil)
+	if err == nil || !runtime.IsNotRegisteredError(err) {
+		return obj, groupVersionKind, err
+	}
+
+	data, err := k8syaml.ToJSON(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return unstructured.UnstructuredJSONScheme.Decode(data, nil, nil)
+}
+
+func isCustomResourceDefinition(groupVersionKind *schema.GroupVersionKind) bool {
+	return groupVersionKind.Group == CustomResourceDefinitionGroup && groupVersionKind.Kind == CustomResourceDefinitionKind
+}
+
+// getCRDApiVersions returns the api versions served by the custom resource definition,
+// from spec.version of apiextensions.k8s.io/v1beta1 and from spec.versions
+func getCRDApiVersions(crd *unstructured.Unstructured) []string {
+	group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	if group == "" {
+		return nil
+	}
+
+	var apiVersions []string
+	appendVersion := func(version string) {
+		apiVersion := fmt.Sprintf("%s/%s", group, version)
+		for _, v := range apiVersions {
+			if v == apiVersion {
+				return
+			}
+		}
+		apiVersions = append(apiVersions, apiVersion)
+	}
+
+	version, _, _ := unstructured.NestedString(crd.Object, "spec", "version")
+	if version != "" {
+		appendVersion(version)
+	}
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if served, ok := m["served"].(bool); ok && !served {
+			continue
+		}
+		if name, ok := m["name"].(string); ok && name != "" {
+			appendVersion(name)
+		}
+	}
+	return apiVersions
+}
+
+// getChartCRDs decodes the custom resource definitions in the crds/ directories of the chart and its subcharts,
+// these files are installed as they are before the templates rather than rendered
+func getChartCRDs(c *chart.Chart) ([]*unstructured.Unstructured, error) {
+	var crds []*unstructured.Unstructured
+	for _, f := range c.CRDs() {
+		r := k8syaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(f.Data)))
+		for {
+			doc, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("read file [%s] in chart failed: %+v", f.Name, err)
+			}
+			if len(bytes.TrimSpace(doc)) == 0 {
+				continue
+			}
+
+			obj, groupVersionKind, err := decodeManifest(doc)
+			if err != nil {
+				return nil, fmt.Errorf("decode file [%s] in chart failed: %+v", f.Name, err)
+			}
+			crd, ok := obj.(*unstructured.Unstructured)
+			if !ok || !isCustomResourceDefinition(groupVersionKind) {
+				return nil, fmt.Errorf("file [%s] in chart is not a custom resource definition but [%s]", f.Name, groupVersionKind.Kind)
+			}
+			crds = append(crds, crd)
+		}
+	}
+	return crds, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"strings"
+	"testing"
+
+	"helm.sh/helm/pkg/chart"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testCRD = `apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: crontabs.stable.example.com
+spec:
+  group: stable.example.com
+  version: v1
+  versions:
+  - name: v1
+    served: true
+    storage: true
+  - name: v2
+    served: true
+    storage: false
+  - name: v1alpha1
+    served: false
+    storage: false
+  names:
+    kind: CronTab
+    plural: crontabs
+  scope: Namespaced
+`
+
+func TestDecodeManifest(t *testing.T) {
+	obj, groupVersionKind, err := decodeManifest([]byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: mysql\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := obj.(*corev1.Service); !ok || groupVersionKind.Kind != "Service" {
+		t.Errorf("expected service decoded as typed object, got [%T]", obj)
+	}
+
+	obj, groupVersionKind, err = decodeManifest([]byte("apiVersion: stable.example.com/v1\nkind: CronTab\nmetadata:\n  name: backup\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, ok := obj.(*unstructured.Unstructured)
+	if !ok || o.GetName() != "backup" || groupVersionKind.GroupVersion().String() != "stable.example.com/v1" {
+		t.Errorf("expected custom resource decoded as unstructured, got [%T] [%+v]", obj, groupVersionKind)
+	}
+
+	_, _, err = decodeManifest([]byte("kind: CronTab\n"))
+	if err == nil {
+		t.Errorf("expected error for document without apiVersion")
+	}
+}
+
+func TestGetChartCRDs(t *testing.T) {
+	c := newTestChart()
+	subchart := newTestSubchart("redis", "0.1.0")
+	subchart.Files = append(subchart.Files, &chart.File{Name: "crds/crontab.yaml", Data: []byte("---\n" + testCRD)})
+	c.AddDependency(subchart)
+
+	crds, err := getChartCRDs(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crds) != 1 || crds[0].GetName() != "crontabs.stable.example.com" {
+		t.Fatalf("expected crd of the subchart, got [%+v]", crds)
+	}
+	apiVersions := getCRDApiVersions(crds[0])
+	if strings.Join(apiVersions, ",") != "stable.example.com/v1,stable.example.com/v2" {
+		t.Errorf("expected served api versions of the crd, got [%+v]", apiVersions)
+	}
+
+	c.Files = append(c.Files, &chart.File{Name: "crds/service.yaml", Data: []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: mysql\n")})
+	_, err = getChartCRDs(c)
+	if err == nil {
+		t.Errorf("expected error for crds/ with resources other than crd")
+	}
+}
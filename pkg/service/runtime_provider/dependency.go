@@ -0,0 +1,377 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chart/loader"
+	"helm.sh/helm/pkg/chartutil"
+	"helm.sh/helm/pkg/getter"
+	"helm.sh/helm/pkg/repo"
+
+	appclient "openpitrix.io/openpitrix/pkg/client/app"
+	"openpitrix.io/openpitrix/pkg/constants"
+	"openpitrix.io/openpitrix/pkg/db"
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/logger"
+	"openpitrix.io/openpitrix/pkg/pb"
+	"openpitrix.io/openpitrix/pkg/util/pbutil"
+)
+
+// OpenPitrixRepository is the repository of the dependencies resolved from the app versions hosted by OpenPitrix,
+// "openpitrix://" finds the app by the chart name, "openpitrix://<app id>" pins the app
+const OpenPitrixRepository = "openpitrix://"
+
+// MaxDependencyDepth is the max depth of the subcharts resolved for a chart
+const MaxDependencyDepth = 8
+
+var dependencyCache = NewChartPackageCache()
+
+// ChartPackageCache keeps the packages of the resolved subcharts, a package is loaded again for every
+// parent chart since loaded charts are bound to their parents
+type ChartPackageCache struct {
+	lock     sync.RWMutex
+	packages map[string][]byte
+}
+
+func NewChartPackageCache() *ChartPackageCache {
+	return &ChartPackageCache{packages: make(map[string][]byte)}
+}
+
+func (c *ChartPackageCache) Get(key string) ([]byte, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	pkg, ok := c.packages[key]
+	return pkg, ok
+}
+
+func (c *ChartPackageCache) Set(key string, pkg []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.packages[key] = pkg
+}
+
+// DependencyResolver adds the dependencies declared in Chart.yaml or requirements.yaml but not vendored
+// into charts/ of a chart, every package resolved is verified when the provenance policy has a keyring
+type DependencyResolver struct {
+	ctx          context.Context
+	Repositories []*ChartRepositoryOptions
+	Registries   []*RegistryOptions
+	Provenance   *ProvenanceOptions
+	Cache        *ChartPackageCache
+}
+
+func NewDependencyResolver(ctx context.Context, runtimeId string) *DependencyResolver {
+	options := GetRuntimeOptions(runtimeId)
+	return &DependencyResolver{
+		ctx:          ctx,
+		Repositories: options.ChartRepositories,
+		Registries:   options.Registries,
+		Provenance:   options.Provenance,
+		Cache:        dependencyCache,
+	}
+}
+
+// Resolve adds the missing dependencies of c enabled by the values, and the missing dependencies of them
+func (r *DependencyResolver) Resolve(c *chart.Chart, vals map[string]interface{}) error {
+	return r.resolve(c, vals, 0)
+}
+
+func (r *DependencyResolver) resolve(c *chart.Chart, vals map[string]interface{}, depth int) error {
+	if len(c.Metadata.Dependencies) == 0 {
+		return nil
+	}
+	if depth >= MaxDependencyDepth {
+		return fmt.Errorf("dependencies of chart [%s] are nested deeper than [%d]", c.Name(), MaxDependencyDepth)
+	}
+
+	cvals, err := chartutil.CoalesceValues(c, vals)
+	if err != nil {
+		return err
+	}
+
+	for _, dependency := range c.Metadata.Dependencies {
+		subchart := findDependency(c.Dependencies(), dependency)
+		if subchart == nil {
+			if !isDependencyEnabled(dependency, cvals) {
+				continue
+			}
+
+			subchart, err = r.fetch(dependency)
+			if gerr.IsGRPCError(err) {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("resolve dependency [%s] of chart [%s] failed: %+v", dependency.Name, c.Name(), err)
+			}
+			logger.Debug(r.ctx, "Resolved dependency [%s] of chart [%s] with version [%s]", dependency.Name, c.Name(), subchart.Metadata.Version)
+			c.AddDependency(subchart)
+		}
+
+		name := dependency.Name
+		if dependency.Alias != "" {
+			name = dependency.Alias
+		}
+		subVals, _ := cvals[name].(map[string]interface{})
+		err = r.resolve(subchart, subVals, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findDependency returns the subchart satisfying the name and the version range of the dependency
+func findDependency(charts []*chart.Chart, dependency *chart.Dependency) *chart.Chart {
+	for _, c := range charts {
+		if c.Name() != dependency.Name {
+			continue
+		}
+		if dependency.Version == "" || chartutil.IsCompatibleRange(dependency.Version, c.Metadata.Version) {
+			return c
+		}
+	}
+	return nil
+}
+
+// isDependencyEnabled evaluates the tags and then the condition of the dependency the same way as helm does
+func isDependencyEnabled(dependency *chart.Dependency, cvals chartutil.Values) bool {
+	enabled := true
+
+	if tags, err := cvals.Table("tags"); err == nil {
+		var hasTrue, hasFalse bool
+		for _, tag := range dependency.Tags {
+			if b, ok := tags[tag].(bool); ok {
+				hasTrue = hasTrue || b
+				hasFalse = hasFalse || !b
+			}
+		}
+		enabled = hasTrue || !hasFalse
+	}
+
+	for _, condition := range strings.Split(strings.TrimSpace(dependency.Condition), ",") {
+		if condition == "" {
+			continue
+		}
+		v, err := cvals.PathValue(condition)
+		if err != nil || v == nil {
+			continue
+		}
+		if b, ok := v.(bool); ok {
+			enabled = b
+		}
+		break
+	}
+	return enabled
+}
+
+// load verifies the package of the dependency and loads it
+func (r *DependencyResolver) load(pkg []byte) (*chart.Chart, error) {
+	_, err := verifyPackageProvenance(r.ctx, r.Provenance, pkg)
+	if err != nil {
+		return nil, err
+	}
+	return loader.LoadArchive(bytes.NewReader(pkg))
+}
+
+func (r *DependencyResolver) fetch(dependency *chart.Dependency) (*chart.Chart, error) {
+	if strings.HasPrefix(dependency.Repository, OpenPitrixRepository) {
+		return r.fetchFromAppVersions(dependency)
+	}
+	// the charts in OCI registries are tagged by their versions, so the version of the dependency is exact
+	if IsOCIReference(dependency.Repository) {
+		puller := &OCIPuller{ctx: r.ctx, Registries: r.Registries, Cache: r.Cache}
+		pkg, err := puller.PullPackage(fmt.Sprintf("%s/%s:%s", strings.TrimSuffix(dependency.Repository, "/"), dependency.Name, dependency.Version))
+		if err != nil {
+			return nil, err
+		}
+		return r.load(pkg)
+	}
+
+	for _, repository := range r.Repositories {
+		if dependency.Repository == "@"+repository.Name || dependency.Repository == "alias:"+repository.Name ||
+			strings.TrimSuffix(dependency.Repository, "/") == strings.TrimSuffix(repository.Url, "/") {
+			return r.fetchFromRepository(repository, dependency)
+		}
+	}
+	return nil, fmt.Errorf("chart repository [%s] is not configured", dependency.Repository)
+}
+
+func (r *DependencyResolver) fetchFromRepository(repository *ChartRepositoryOptions, dependency *chart.Dependency) (*chart.Chart, error) {
+	index, err := repo.LoadIndexFile(repository.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	chartVersion, err := index.Get(dependency.Name, dependency.Version)
+	if err != nil {
+		return nil, err
+	}
+	if len(chartVersion.URLs) == 0 {
+		return nil, fmt.Errorf("chart [%s-%s] has no url in repository [%s]", chartVersion.Name, chartVersion.Version, repository.Name)
+	}
+
+	key := fmt.Sprintf("%s/%s-%s", repository.Index, chartVersion.Name, chartVersion.Version)
+	pkg, ok := r.Cache.Get(key)
+	if !ok {
+		pkg, err = r.download(repository, chartVersion.URLs[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if chartVersion.Digest != "" {
+			digest := sha256.Sum256(pkg)
+			if hex.EncodeToString(digest[:]) != chartVersion.Digest {
+				return nil, fmt.Errorf("digest of chart [%s-%s] mismatches the index", chartVersion.Name, chartVersion.Version)
+			}
+		}
+		r.Cache.Set(key, pkg)
+	}
+	return r.load(pkg)
+}
+
+// download reads the chart package at chartUrl, which is relative to the repository url,
+// or to the directory of the index when the repository has no url
+func (r *DependencyResolver) download(repository *ChartRepositoryOptions, chartUrl string) ([]byte, error) {
+	var err error
+	if repository.Url != "" {
+		chartUrl, err = repo.ResolveReferenceURL(repository.Url, chartUrl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u, err := url.Parse(chartUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		g, err := getter.NewHTTPGetter(getter.WithURL(chartUrl))
+		if err != nil {
+			return nil, err
+		}
+		buf, err := g.Get(chartUrl)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "file":
+		return ioutil.ReadFile(u.Path)
+	case "":
+		if !filepath.IsAbs(u.Path) {
+			return ioutil.ReadFile(filepath.Join(filepath.Dir(repository.Index), u.Path))
+		}
+		return ioutil.ReadFile(u.Path)
+	default:
+		return nil, fmt.Errorf("scheme [%s] of chart url [%s] is not supported", u.Scheme, chartUrl)
+	}
+}
+
+// fetchFromAppVersions resolves the dependency from the latest active app version in its version range
+func (r *DependencyResolver) fetchFromAppVersions(dependency *chart.Dependency) (*chart.Chart, error) {
+	appClient, err := appclient.NewAppManagerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	appIds := []string{strings.TrimPrefix(dependency.Repository, OpenPitrixRepository)}
+	if appIds[0] == "" {
+		appsResp, err := appClient.DescribeApps(r.ctx, &pb.DescribeAppsRequest{
+			ChartName: []string{dependency.Name},
+			Status:    []string{constants.StatusActive},
+		})
+		if err != nil {
+			return nil, err
+		}
+		appIds = nil
+		for _, app := range appsResp.AppSet {
+			appIds = append(appIds, app.GetAppId().GetValue())
+		}
+		if len(appIds) == 0 {
+			return nil, fmt.Errorf("no active app of chart [%s] found", dependency.Name)
+		}
+	}
+
+	versionsResp, err := appClient.DescribeAppVersions(r.ctx, &pb.DescribeAppVersionsRequest{
+		AppId:  appIds,
+		Status: []string{constants.StatusActive},
+		Limit:  db.DefaultSelectLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	versionId, err := selectAppVersion(versionsResp.AppVersionSet, dependency.Version)
+	if err != nil {
+		return nil, fmt.Errorf("chart [%s]: %+v", dependency.Name, err)
+	}
+
+	key := OpenPitrixRepository + versionId
+	pkg, ok := r.Cache.Get(key)
+	if !ok {
+		pkgResp, err := appClient.GetAppVersionPackage(r.ctx, &pb.GetAppVersionPackageRequest{
+			VersionId: pbutil.ToProtoString(versionId),
+		})
+		if err != nil {
+			return nil, err
+		}
+		pkg = pkgResp.GetPackage()
+		r.Cache.Set(key, pkg)
+	}
+
+	c, err := r.load(pkg)
+	if err != nil {
+		return nil, err
+	}
+	if c.Name() != dependency.Name {
+		return nil, fmt.Errorf("app version [%s] is chart [%s] rather than [%s]", versionId, c.Name(), dependency.Name)
+	}
+	return c, nil
+}
+
+// selectAppVersion returns the id of the highest app version in the version range, the name of
+// an app version of helm chart starts with the chart version, e.g. "0.1.0 [1.0.0]"
+func selectAppVersion(appVersions []*pb.AppVersion, versionRange string) (string, error) {
+	if versionRange == "" {
+		versionRange = "*"
+	}
+	constraint, err := semver.NewConstraint(versionRange)
+	if err != nil {
+		return "", err
+	}
+
+	var selectedId string
+	var selected *semver.Version
+	for _, appVersion := range appVersions {
+		fields := strings.Fields(appVersion.GetName().GetValue())
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := semver.NewVersion(fields[0])
+		if err != nil || !constraint.Check(v) {
+			continue
+		}
+		if selected == nil || v.GreaterThan(selected) {
+			selectedId, selected = appVersion.GetVersionId().GetValue(), v
+		}
+	}
+	if selected == nil {
+		return "", fmt.Errorf("no active app version in range [%s]", versionRange)
+	}
+	return selectedId, nil
+}
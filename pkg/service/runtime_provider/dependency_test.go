@@ -0,0 +1,209 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chartutil"
+	"helm.sh/helm/pkg/repo"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/pb"
+	"openpitrix.io/openpitrix/pkg/util/pbutil"
+)
+
+func newTestSubchart(name, version string) *chart.Chart {
+	return &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV1,
+			Name:       name,
+			Version:    version,
+		},
+		Templates: []*chart.File{
+			{Name: "templates/configmap.yaml", Data: []byte(testConfigMapTemplate)},
+		},
+		Values: map[string]interface{}{
+			"image":    map[string]interface{}{"repository": "redis", "tag": version},
+			"replicas": 1,
+		},
+	}
+}
+
+// newTestChartRepository packages the charts into a local repository and returns its index
+func newTestChartRepository(t *testing.T, charts ...*chart.Chart) string {
+	dir, err := ioutil.TempDir("", "chart-repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range charts {
+		_, err = chartutil.Save(c, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index, err := repo.IndexDirectory(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile := filepath.Join(dir, "index.yaml")
+	err = index.WriteFile(indexFile, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indexFile
+}
+
+func TestResolveDependencies(t *testing.T) {
+	indexFile := newTestChartRepository(t,
+		newTestSubchart("redis", "0.1.0"),
+		newTestSubchart("redis", "0.1.5"),
+		newTestSubchart("redis", "1.0.0"),
+	)
+	defer os.RemoveAll(filepath.Dir(indexFile))
+
+	newParent := func() *chart.Chart {
+		c := newTestChart()
+		c.Metadata.Dependencies = []*chart.Dependency{
+			{Name: "redis", Version: "~0.1.0", Repository: "@local"},
+			{Name: "mysql", Version: "1.0.0", Repository: "@local", Condition: "mysql.enabled"},
+			{Name: "cache", Version: "1.0.0", Repository: "@local", Tags: []string{"cache"}},
+		}
+		c.Values["mysql"] = map[string]interface{}{"enabled": false}
+		return c
+	}
+
+	resolver := &DependencyResolver{
+		ctx:          context.Background(),
+		Repositories: []*ChartRepositoryOptions{{Name: "local", Index: indexFile}},
+		Cache:        NewChartPackageCache(),
+	}
+
+	c := newParent()
+	err := resolver.Resolve(c, map[string]interface{}{"tags": map[string]interface{}{"cache": false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the disabled dependencies are not in the repository, resolving them would fail
+	if len(c.Dependencies()) != 1 {
+		t.Fatalf("expected [1] dependency resolved, got [%d]", len(c.Dependencies()))
+	}
+	redis := c.Dependencies()[0]
+	if redis.Name() != "redis" || redis.Metadata.Version != "0.1.5" || redis.Parent() != c {
+		t.Errorf("expected redis [0.1.5] in range [~0.1.0], got [%s] [%s]", redis.Name(), redis.Metadata.Version)
+	}
+
+	// the values enable the dependency
+	c = newParent()
+	err = resolver.Resolve(c, map[string]interface{}{"mysql": map[string]interface{}{"enabled": true}})
+	if err == nil {
+		t.Errorf("expected error for dependency [mysql] not in the repository")
+	}
+
+	// the resolved packages are cached
+	err = os.Remove(filepath.Join(filepath.Dir(indexFile), "redis-0.1.5.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newParent()
+	err = resolver.Resolve(c, map[string]interface{}{"tags": map[string]interface{}{"cache": false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Dependencies()) != 1 || c.Dependencies()[0] == redis {
+		t.Errorf("expected redis loaded again from the cache")
+	}
+
+	// the vendored dependencies are kept
+	c = newParent()
+	c.Metadata.Dependencies = c.Metadata.Dependencies[:1]
+	c.AddDependency(newTestSubchart("redis", "0.1.0"))
+	err = resolver.Resolve(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Dependencies()) != 1 || c.Dependencies()[0].Metadata.Version != "0.1.0" {
+		t.Errorf("expected vendored redis [0.1.0] kept")
+	}
+
+	_, err = (&DependencyResolver{Cache: NewChartPackageCache()}).fetch(&chart.Dependency{Name: "redis", Repository: "@stable"})
+	if err == nil {
+		t.Errorf("expected error for repository not configured")
+	}
+}
+
+func TestSelectAppVersion(t *testing.T) {
+	appVersions := []*pb.AppVersion{
+		{VersionId: pbutil.ToProtoString("appv-1"), Name: pbutil.ToProtoString("0.1.0 [5.7]")},
+		{VersionId: pbutil.ToProtoString("appv-2"), Name: pbutil.ToProtoString("0.2.0 [5.7]")},
+		{VersionId: pbutil.ToProtoString("appv-3"), Name: pbutil.ToProtoString("1.0.0 [8.0]")},
+		{VersionId: pbutil.ToProtoString("appv-4"), Name: pbutil.ToProtoString("latest")},
+	}
+
+	for versionRange, expected := range map[string]string{
+		"":       "appv-3",
+		"~0.1.0": "appv-1",
+		"<1.0.0": "appv-2",
+	} {
+		versionId, err := selectAppVersion(appVersions, versionRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versionId != expected {
+			t.Errorf("expected app version [%s] in range [%s], got [%s]", expected, versionRange, versionId)
+		}
+	}
+
+	_, err := selectAppVersion(appVersions, ">2.0.0")
+	if err == nil {
+		t.Errorf("expected error for no app version in range")
+	}
+}
+
+func TestResolveSignedDependencies(t *testing.T) {
+	indexFile := newTestChartRepository(t, newTestSubchart("test", "0.1.0"), newTestSubchart("redis", "0.1.0"))
+	defer os.RemoveAll(filepath.Dir(indexFile))
+
+	pkg, err := ioutil.ReadFile(filepath.Join(filepath.Dir(indexFile), "test-0.1.0.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := newTestProvenance(t, pkg)
+	defer os.RemoveAll(options.Dir)
+
+	resolver := &DependencyResolver{
+		ctx:          context.Background(),
+		Repositories: []*ChartRepositoryOptions{{Name: "local", Index: indexFile}},
+		Provenance:   options,
+		Cache:        NewChartPackageCache(),
+	}
+
+	c := newTestChart()
+	c.Metadata.Name = "parent"
+	c.Metadata.Dependencies = []*chart.Dependency{{Name: "test", Version: "0.1.0", Repository: "@local"}}
+	err = resolver.Resolve(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Dependencies()) != 1 {
+		t.Errorf("expected signed dependency resolved")
+	}
+
+	// the dependency without provenance file is refused
+	c = newTestChart()
+	c.Metadata.Name = "parent"
+	c.Metadata.Dependencies = []*chart.Dependency{{Name: "redis", Version: "0.1.0", Repository: "@local"}}
+	err = resolver.Resolve(c, nil)
+	if !gerr.IsGRPCError(err) {
+		t.Errorf("expected grpc error for dependency not verified, got [%+v]", err)
+	}
+}
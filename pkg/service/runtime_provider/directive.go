@@ -6,17 +6,61 @@ package runtime_provider
 
 import (
 	"context"
+	"fmt"
 
 	runtimeclient "openpitrix.io/openpitrix/pkg/client/runtime"
 	"openpitrix.io/openpitrix/pkg/models"
 	"openpitrix.io/openpitrix/pkg/util/jsonutil"
 )
 
+const (
+	// ValuesPolicyReuse keeps the values of the previous release
+	ValuesPolicyReuse = "reuse"
+	// ValuesPolicyReset uses the chart defaults overridden by the new values
+	ValuesPolicyReset = "reset"
+	// ValuesPolicyMerge merges the new values over the values of the previous release
+	ValuesPolicyMerge = "merge"
+
+	ValuesPolicyKey = "ValuesPolicy"
+	// RevisionKey is the revision of the release to roll back to, the previous one when not set
+	RevisionKey = "Revision"
+	// SkipTestKey skips the test hooks of the release after install and upgrade
+	SkipTestKey = "SkipTest"
+	// RollbackOnTestFailureKey rolls an upgraded release back when its test hooks fail
+	RollbackOnTestFailureKey = "RollbackOnTestFailure"
+)
+
+// ReservedKeys are the keys in Conf read by the provider, which are not values of the chart
+var ReservedKeys = []string{
+	"Name",
+	"Description",
+	ValuesPolicyKey,
+	RevisionKey,
+	SkipTestKey,
+	RollbackOnTestFailureKey,
+	SkipCRDsKey,
+	ChartReferenceKey,
+}
+
+// getChartValues returns a copy of the custom values without the reserved keys
+func getChartValues(customVals map[string]interface{}) map[string]interface{} {
+	vals := CopyValues(customVals)
+	for _, key := range ReservedKeys {
+		delete(vals, key)
+	}
+	return vals
+}
+
 type JobDirective struct {
-	Namespace   string
-	RuntimeId   string
-	Values      string
-	ClusterName string
+	Namespace             string
+	RuntimeId             string
+	Values                string
+	ClusterName           string
+	ValuesPolicy          string
+	Revision              int
+	SkipTest              bool
+	RollbackOnTestFailure bool
+	SkipCRDs              bool
 }
 
 func decodeJobDirective(ctx context.Context, data string) (*JobDirective, error) {
@@ -34,11 +78,38 @@ func decodeJobDirective(ctx context.Context, data string) (*JobDirective, error)
 
 	namespace := runtime.Zone
 
+	var valuesPolicy string
+	var revision int
+	var skipTest, rollbackOnTestFailure, skipCRDs bool
+	if len(clusterWrapper.Cluster.Env) > 0 {
+		var vals map[string]interface{}
+		err = jsonutil.Decode([]byte(clusterWrapper.Cluster.Env), &vals)
+		if err != nil {
+			return nil, err
+		}
+		valuesPolicy, _ = GetStringFromValues(vals, ValuesPolicyKey)
+
+		if _, ok := vals[RevisionKey]; ok {
+			revision, ok = GetIntFromValues(vals, RevisionKey)
+			if !ok || revision < 0 {
+				return nil, fmt.Errorf("config [%s] must be a revision of the release", RevisionKey)
+			}
+		}
+		skipTest, _ = GetBoolFromValues(vals, SkipTestKey)
+		rollbackOnTestFailure, _ = GetBoolFromValues(vals, RollbackOnTestFailureKey)
+		skipCRDs, _ = GetBoolFromValues(vals, SkipCRDsKey)
+	}
+
 	j := &JobDirective{
-		Namespace:   namespace,
-		RuntimeId:   runtimeId,
-		Values:      clusterWrapper.Cluster.Env,
-		ClusterName: clusterWrapper.Cluster.Name,
+		Namespace:             namespace,
+		RuntimeId:             runtimeId,
+		Values:                clusterWrapper.Cluster.Env,
+		ClusterName:           clusterWrapper.Cluster.Name,
+		ValuesPolicy:          valuesPolicy,
+		Revision:              revision,
+		SkipTest:              skipTest,
+		RollbackOnTestFailure: rollbackOnTestFailure,
+		SkipCRDs:              skipCRDs,
 	}
 
 	return j, nil
@@ -51,6 +122,13 @@ type TaskDirective struct {
 	Values            string
 	ClusterName       string
 	RawClusterWrapper string
+	ValuesPolicy      string
+	Revision          int
+	// SkipCRDs is used by the create task only
+	SkipCRDs bool
+	// RollbackOnTestFailure and TestResults are used by the test task only
+	RollbackOnTestFailure bool
+	TestResults           []*ReleaseTestResult
 }
 
 func encodeTaskDirective(v interface{}) string {
@@ -11,13 +11,14 @@ import (
 	"strings"
 
 	"google.golang.org/grpc/transport"
-	"k8s.io/helm/pkg/chartutil"
-	"k8s.io/helm/pkg/proto/hapi/chart"
-	"k8s.io/helm/pkg/proto/hapi/release"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chart/loader"
+	"helm.sh/helm/pkg/release"
 
 	appclient "openpitrix.io/openpitrix/pkg/client/app"
 	runtimeclient "openpitrix.io/openpitrix/pkg/client/runtime"
 	"openpitrix.io/openpitrix/pkg/constants"
+	"openpitrix.io/openpitrix/pkg/gerr"
 	"openpitrix.io/openpitrix/pkg/logger"
 	"openpitrix.io/openpitrix/pkg/models"
 	"openpitrix.io/openpitrix/pkg/pb"
@@ -26,12 +27,36 @@ import (
 	"openpitrix.io/openpitrix/pkg/util/pbutil"
 )
 
-func getChartAndAppId(ctx context.Context, versionId string) (*chart.Chart, string, error) {
+// getChartPackageAndAppId returns the package of the chart at the OCI reference in Conf if any and allowed by the runtime,
+// or the package of the app version, which is an OCI reference as well when the chart is kept in a registry
+func getChartPackageAndAppId(ctx context.Context, versionId, runtimeId string, rawVals []byte) ([]byte, string, error) {
 	appClient, err := appclient.NewAppManagerClient()
 	if err != nil {
 		return nil, "", err
 	}
 
+	if ref, ok := getChartReference(rawVals); ok {
+		if !isChartReferenceAllowed(GetRuntimeOptions(runtimeId).ChartReferences, ref) {
+			return nil, "", gerr.New(ctx, gerr.PermissionDenied, gerr.ErrorUnsupportedParameterValue, ChartReferenceKey, ref)
+		}
+
+		resp, err := appClient.DescribeAppVersions(ctx, &pb.DescribeAppVersionsRequest{
+			VersionId: []string{versionId},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if len(resp.AppVersionSet) == 0 {
+			return nil, "", fmt.Errorf("app version [%s] not found", versionId)
+		}
+
+		pkg, err := NewOCIPuller(ctx, runtimeId).PullPackage(ref)
+		if err != nil {
+			return nil, "", err
+		}
+		return pkg, resp.AppVersionSet[0].GetAppId().GetValue(), nil
+	}
+
 	req := pb.GetAppVersionPackageRequest{
 		VersionId: pbutil.ToProtoString(versionId),
 	}
@@ -42,13 +67,53 @@ func getChartAndAppId(ctx context.Context, versionId string) (*chart.Chart, stri
 	}
 
 	pkg := resp.GetPackage()
+	if ref := string(bytes.TrimSpace(pkg)); IsOCIReference(ref) {
+		pkg, err = NewOCIPuller(ctx, runtimeId).PullPackage(ref)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return pkg, resp.GetAppId().GetValue(), nil
+}
+
+// getChartAndAppId loads the chart package verified when the runtime requires signed charts
+func getChartAndAppId(ctx context.Context, versionId, runtimeId string, rawVals []byte) (*chart.Chart, string, *ChartProvenance, error) {
+	pkg, appId, err := getChartPackageAndAppId(ctx, versionId, runtimeId, rawVals)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	provenance, err := verifyChartProvenance(ctx, runtimeId, pkg)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
 	r := bytes.NewReader(pkg)
 
-	c, err := chartutil.LoadArchive(r)
+	c, err := loader.LoadArchive(r)
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, err
+	}
+	return c, appId, provenance, nil
+}
+
+// getResolvedChartAndAppId loads the chart of the app version with the dependencies enabled by the values in rawVals resolved
+func getResolvedChartAndAppId(ctx context.Context, versionId, runtimeId string, rawVals []byte) (*chart.Chart, string, *ChartProvenance, error) {
+	c, appId, provenance, err := getChartAndAppId(ctx, versionId, runtimeId, rawVals)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	vals, err := getReleaseValues(c, rawVals)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	err = NewDependencyResolver(ctx, runtimeId).Resolve(c, vals)
+	if err != nil {
+		return nil, "", nil, err
 	}
-	return c, resp.GetAppId().GetValue(), nil
+	return c, appId, provenance, nil
 }
 
 func (p *Server) ParseClusterConf(ctx context.Context, req *pb.ParseClusterConfRequest) (*pb.ParseClusterConfResponse, error) {
@@ -57,7 +122,7 @@ func (p *Server) ParseClusterConf(ctx context.Context, req *pb.ParseClusterConfR
 	conf := req.GetConf().GetValue()
 	cluster := models.PbToClusterWrapper(req.GetCluster())
 
-	c, appId, err := getChartAndAppId(ctx, versionId)
+	c, appId, provenance, err := getResolvedChartAndAppId(ctx, versionId, runtimeId, []byte(conf))
 	if err != nil {
 		logger.Error(ctx, "Load helm chart from app version [%s] failed: %+v", versionId, err)
 		return nil, err
@@ -70,12 +135,13 @@ func (p *Server) ParseClusterConf(ctx context.Context, req *pb.ParseClusterConfR
 	namespace := runtime.Zone
 
 	parser := Parser{
-		ctx:       ctx,
-		Chart:     c,
-		Conf:      conf,
-		VersionId: versionId,
-		RuntimeId: runtimeId,
-		Namespace: namespace,
+		ctx:        ctx,
+		Chart:      c,
+		Conf:       conf,
+		VersionId:  versionId,
+		RuntimeId:  runtimeId,
+		Namespace:  namespace,
+		Provenance: provenance,
 	}
 	err = parser.Parse(cluster, appId)
 	if err != nil {
@@ -88,6 +154,28 @@ func (p *Server) ParseClusterConf(ctx context.Context, req *pb.ParseClusterConfR
 	}, err
 }
 
+// getTestTaskLayer returns the layer testing the release deployed by the job, nil when the tests are skipped
+func getTestTaskLayer(job *models.Job, jobDirective *JobDirective, rollbackOnTestFailure bool) *models.TaskLayer {
+	if jobDirective.SkipTest {
+		return nil
+	}
+
+	td := TaskDirective{
+		Namespace:             jobDirective.Namespace,
+		RuntimeId:             jobDirective.RuntimeId,
+		ClusterName:           jobDirective.ClusterName,
+		RawClusterWrapper:     job.Directive,
+		RollbackOnTestFailure: rollbackOnTestFailure,
+	}
+	tdj := encodeTaskDirective(td)
+
+	task := models.NewTask(constants.PlaceHolder, job.JobId, "", jobDirective.RuntimeId, ActionTestCluster, tdj, sender.OwnerPath(job.OwnerPath), false)
+	return &models.TaskLayer{
+		Tasks: []*models.Task{task},
+		Child: nil,
+	}
+}
+
 func (p *Server) SplitJobIntoTasks(ctx context.Context, req *pb.SplitJobIntoTasksRequest) (*pb.SplitJobIntoTasksResponse, error) {
 	job := models.PbToJob(req.GetJob())
 	jobDirective, err := decodeJobDirective(ctx, job.Directive)
@@ -106,15 +194,21 @@ func (p *Server) SplitJobIntoTasks(ctx context.Context, req *pb.SplitJobIntoTask
 			Values:            jobDirective.Values,
 			ClusterName:       jobDirective.ClusterName,
 			RawClusterWrapper: job.Directive,
+			SkipCRDs:          jobDirective.SkipCRDs,
 		}
 		tdj := encodeTaskDirective(td)
 
 		task := models.NewTask(constants.PlaceHolder, job.JobId, "", jobDirective.RuntimeId, constants.ActionCreateCluster, tdj, sender.OwnerPath(job.OwnerPath), false)
 		tl = &models.TaskLayer{
 			Tasks: []*models.Task{task},
-			Child: nil,
+			Child: getTestTaskLayer(job, jobDirective, false),
 		}
 	case constants.ActionUpgradeCluster:
+		valuesPolicy := jobDirective.ValuesPolicy
+		if valuesPolicy == "" {
+			valuesPolicy = ValuesPolicyReset
+		}
+
 		td := TaskDirective{
 			VersionId:         job.VersionId,
 			Namespace:         jobDirective.Namespace,
@@ -122,15 +216,21 @@ func (p *Server) SplitJobIntoTasks(ctx context.Context, req *pb.SplitJobIntoTask
 			Values:            jobDirective.Values,
 			ClusterName:       jobDirective.ClusterName,
 			RawClusterWrapper: job.Directive,
+			ValuesPolicy:      valuesPolicy,
 		}
 		tdj := encodeTaskDirective(td)
 
 		task := models.NewTask(constants.PlaceHolder, job.JobId, "", jobDirective.RuntimeId, constants.ActionUpgradeCluster, tdj, sender.OwnerPath(job.OwnerPath), false)
 		tl = &models.TaskLayer{
 			Tasks: []*models.Task{task},
-			Child: nil,
+			Child: getTestTaskLayer(job, jobDirective, jobDirective.RollbackOnTestFailure),
 		}
 	case constants.ActionUpdateClusterEnv:
+		valuesPolicy := jobDirective.ValuesPolicy
+		if valuesPolicy == "" {
+			valuesPolicy = ValuesPolicyMerge
+		}
+
 		td := TaskDirective{
 			VersionId:         job.VersionId,
 			Namespace:         jobDirective.Namespace,
@@ -138,13 +238,14 @@ func (p *Server) SplitJobIntoTasks(ctx context.Context, req *pb.SplitJobIntoTask
 			Values:            jobDirective.Values,
 			ClusterName:       jobDirective.ClusterName,
 			RawClusterWrapper: job.Directive,
+			ValuesPolicy:      valuesPolicy,
 		}
 		tdj := encodeTaskDirective(td)
 
 		task := models.NewTask(constants.PlaceHolder, job.JobId, "", jobDirective.RuntimeId, constants.ActionUpgradeCluster, tdj, sender.OwnerPath(job.OwnerPath), false)
 		tl = &models.TaskLayer{
 			Tasks: []*models.Task{task},
-			Child: nil,
+			Child: getTestTaskLayer(job, jobDirective, jobDirective.RollbackOnTestFailure),
 		}
 	case constants.ActionRollbackCluster:
 		td := TaskDirective{
@@ -152,6 +253,7 @@ func (p *Server) SplitJobIntoTasks(ctx context.Context, req *pb.SplitJobIntoTask
 			RuntimeId:         jobDirective.RuntimeId,
 			ClusterName:       jobDirective.ClusterName,
 			RawClusterWrapper: job.Directive,
+			Revision:          jobDirective.Revision,
 		}
 		tdj := encodeTaskDirective(td)
 
@@ -160,6 +262,50 @@ func (p *Server) SplitJobIntoTasks(ctx context.Context, req *pb.SplitJobIntoTask
 			Tasks: []*models.Task{task},
 			Child: nil,
 		}
+	case constants.ActionRecoverClusters:
+		td := TaskDirective{
+			Namespace:         jobDirective.Namespace,
+			RuntimeId:         jobDirective.RuntimeId,
+			ClusterName:       jobDirective.ClusterName,
+			RawClusterWrapper: job.Directive,
+		}
+		tdj := encodeTaskDirective(td)
+
+		task := models.NewTask(constants.PlaceHolder, job.JobId, "", jobDirective.RuntimeId, constants.ActionRecoverClusters, tdj, sender.OwnerPath(job.OwnerPath), false)
+		tl = &models.TaskLayer{
+			Tasks: []*models.Task{task},
+			Child: nil,
+		}
+	case constants.ActionResizeCluster, constants.ActionAddClusterNodes, constants.ActionDeleteClusterNodes:
+		td := TaskDirective{
+			VersionId:         job.VersionId,
+			Namespace:         jobDirective.Namespace,
+			Values:            jobDirective.Values,
+			RuntimeId:         jobDirective.RuntimeId,
+			ClusterName:       jobDirective.ClusterName,
+			RawClusterWrapper: job.Directive,
+		}
+		tdj := encodeTaskDirective(td)
+
+		task := models.NewTask(constants.PlaceHolder, job.JobId, "", jobDirective.RuntimeId, job.JobAction, tdj, sender.OwnerPath(job.OwnerPath), false)
+		tl = &models.TaskLayer{
+			Tasks: []*models.Task{task},
+			Child: nil,
+		}
+	case constants.ActionStopClusters, constants.ActionStartClusters:
+		td := TaskDirective{
+			Namespace:         jobDirective.Namespace,
+			RuntimeId:         jobDirective.RuntimeId,
+			ClusterName:       jobDirective.ClusterName,
+			RawClusterWrapper: job.Directive,
+		}
+		tdj := encodeTaskDirective(td)
+
+		task := models.NewTask(constants.PlaceHolder, job.JobId, "", jobDirective.RuntimeId, job.JobAction, tdj, sender.OwnerPath(job.OwnerPath), false)
+		tl = &models.TaskLayer{
+			Tasks: []*models.Task{task},
+			Child: nil,
+		}
 	case constants.ActionDeleteClusters:
 		td := TaskDirective{
 			RuntimeId:   jobDirective.RuntimeId,
@@ -192,6 +338,43 @@ func (p *Server) SplitJobIntoTasks(ctx context.Context, req *pb.SplitJobIntoTask
 	}, nil
 }
 
+func getTaskErrorMessage(taskAction string) gerr.ErrorMessage {
+	switch taskAction {
+	case constants.ActionCreateCluster:
+		return gerr.ErrorCreateResourceFailed
+	case constants.ActionUpgradeCluster:
+		return gerr.ErrorUpgradeResourceFailed
+	case constants.ActionRollbackCluster:
+		return gerr.ErrorRollbackResourceFailed
+	case constants.ActionResizeCluster:
+		return gerr.ErrorResizeResourceFailed
+	case constants.ActionAddClusterNodes:
+		return gerr.ErrorAddResourceNodeFailed
+	case constants.ActionDeleteClusterNodes:
+		return gerr.ErrorDeleteResourceNodeFailed
+	case constants.ActionStopClusters:
+		return gerr.ErrorStopResourceFailed
+	case constants.ActionStartClusters:
+		return gerr.ErrorStartResourceFailed
+	case constants.ActionRecoverClusters:
+		return gerr.ErrorRecoverResourceFailed
+	case constants.ActionDeleteClusters:
+		return gerr.ErrorDeleteResourceFailed
+	case constants.ActionCeaseClusters:
+		return gerr.ErrorCeaseResourceFailed
+	default:
+		return gerr.ErrorUpdateResourceFailed
+	}
+}
+
+// newTaskError keeps grpc errors such as an illegal credential and wraps the others by the task action
+func newTaskError(ctx context.Context, task *models.Task, clusterName string, err error) error {
+	if gerr.IsGRPCError(err) {
+		return err
+	}
+	return gerr.NewWithDetail(ctx, gerr.Internal, err, getTaskErrorMessage(task.TaskAction), clusterName)
+}
+
 func (p *Server) HandleSubtask(ctx context.Context, req *pb.HandleSubtaskRequest) (*pb.HandleSubtaskResponse, error) {
 	task := models.PbToTask(req.GetTask())
 	taskDirective, err := decodeTaskDirective(task.Directive)
@@ -200,56 +383,132 @@ func (p *Server) HandleSubtask(ctx context.Context, req *pb.HandleSubtaskRequest
 	}
 
 	helmHandler := GetHelmHandler(ctx, taskDirective.RuntimeId)
+	// install and upgrade wait for the release in background, WaitSubtask reports their outcome
+	backgroundHelmHandler := GetHelmHandler(detachContext(ctx), taskDirective.RuntimeId)
 
 	switch task.TaskAction {
 	case constants.ActionCreateCluster:
-		c, _, err := getChartAndAppId(ctx, taskDirective.VersionId)
+		rawVals, err := ConvertJsonToYaml([]byte(taskDirective.Values))
 		if err != nil {
 			return nil, err
 		}
 
-		rawVals, err := ConvertJsonToYaml([]byte(taskDirective.Values))
+		c, _, provenance, err := getResolvedChartAndAppId(ctx, taskDirective.VersionId, taskDirective.RuntimeId, rawVals)
 		if err != nil {
 			return nil, err
 		}
+		setChartProvenance(c, provenance)
 
 		logger.Debug(ctx, "Install helm release with name [%+v], namespace [%+v], values [%s]", taskDirective.ClusterName, taskDirective.Namespace, rawVals)
 
-		err = helmHandler.InstallReleaseFromChart(c, taskDirective.Namespace, rawVals, taskDirective.ClusterName)
+		timeout := task.GetTimeout(constants.WaitHelmTaskTimeout)
+		install, err := backgroundHelmHandler.PrepareInstallRelease(c, rawVals, taskDirective.ClusterName, taskDirective.SkipCRDs, timeout)
 		if err != nil {
-			return nil, err
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
 		}
+		releaseTasks.Start(task.TaskId, install)
 	case constants.ActionUpgradeCluster:
-		c, _, err := getChartAndAppId(ctx, taskDirective.VersionId)
+		rawVals, err := ConvertJsonToYaml([]byte(taskDirective.Values))
 		if err != nil {
 			return nil, err
 		}
 
-		rawVals, err := ConvertJsonToYaml([]byte(taskDirective.Values))
+		c, _, provenance, err := getResolvedChartAndAppId(ctx, taskDirective.VersionId, taskDirective.RuntimeId, rawVals)
 		if err != nil {
 			return nil, err
 		}
+		setChartProvenance(c, provenance)
 
-		logger.Debug(ctx, "Update helm release [%+v] with values [%s]", taskDirective.ClusterName, rawVals)
+		logger.Debug(ctx, "Update helm release [%+v] with values [%s], values policy [%s]", taskDirective.ClusterName, rawVals, taskDirective.ValuesPolicy)
 
-		err = helmHandler.UpdateReleaseFromChart(taskDirective.ClusterName, c, rawVals)
+		timeout := task.GetTimeout(constants.WaitHelmTaskTimeout)
+		update, err := backgroundHelmHandler.PrepareUpdateRelease(taskDirective.ClusterName, c, rawVals, taskDirective.ValuesPolicy, timeout)
+		if err != nil {
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
+		}
+		releaseTasks.Start(task.TaskId, update)
+	case constants.ActionResizeCluster, constants.ActionAddClusterNodes, constants.ActionDeleteClusterNodes:
+		clusterWrapper, err := models.NewClusterWrapper(ctx, taskDirective.RawClusterWrapper)
 		if err != nil {
 			return nil, err
 		}
+
+		rawVals, err := ConvertJsonToYaml([]byte(taskDirective.Values))
+		if err != nil {
+			return nil, err
+		}
+
+		// the chart kept in the release has lost its subcharts, so it is built again from the app version of the cluster
+		c, _, provenance, err := getResolvedChartAndAppId(ctx, taskDirective.VersionId, taskDirective.RuntimeId, rawVals)
+		if err != nil {
+			return nil, err
+		}
+		setChartProvenance(c, provenance)
+
+		// adding and deleting nodes change the replicas of the roles only
+		resources := task.TaskAction == constants.ActionResizeCluster
+		rawVals, err = helmHandler.GetResizeValues(taskDirective.ClusterName, c, clusterWrapper.ClusterRoles, resources)
+		if err != nil {
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
+		}
+
+		logger.Debug(ctx, "Resize helm release [%+v] with values [%s]", taskDirective.ClusterName, rawVals)
+
+		timeout := task.GetTimeout(constants.WaitHelmTaskTimeout)
+		update, err := backgroundHelmHandler.PrepareUpdateRelease(taskDirective.ClusterName, c, rawVals, ValuesPolicyMerge, timeout)
+		if err != nil {
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
+		}
+		releaseTasks.Start(task.TaskId, update)
 	case constants.ActionRollbackCluster:
-		err = helmHandler.RollbackRelease(taskDirective.ClusterName)
+		logger.Debug(ctx, "Rollback helm release [%+v] to revision [%d]", taskDirective.ClusterName, taskDirective.Revision)
+
+		err = helmHandler.RollbackRelease(taskDirective.ClusterName, taskDirective.Revision)
+		if err != nil {
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
+		}
+	case ActionTestCluster:
+		logger.Debug(ctx, "Test helm release [%+v]", taskDirective.ClusterName)
+
+		timeout := task.GetTimeout(constants.WaitHelmTaskTimeout)
+		test, err := backgroundHelmHandler.PrepareTestRelease(taskDirective.ClusterName, timeout)
+		if err != nil {
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
+		}
+		releaseTasks.Start(task.TaskId, test)
+	case constants.ActionRecoverClusters:
+		logger.Debug(ctx, "Recover helm release [%+v]", taskDirective.ClusterName)
+
+		err = helmHandler.RecoverRelease(taskDirective.ClusterName)
+		if err != nil {
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
+		}
+	case constants.ActionStopClusters, constants.ActionStartClusters:
+		clusterWrapper, err := models.NewClusterWrapper(ctx, taskDirective.RawClusterWrapper)
 		if err != nil {
 			return nil, err
 		}
+
+		kubeHandler := GetKubeHandler(ctx, taskDirective.RuntimeId)
+		if task.TaskAction == constants.ActionStopClusters {
+			logger.Debug(ctx, "Stop workloads of helm release [%+v]", taskDirective.ClusterName)
+			err = kubeHandler.StopWorkloads(taskDirective.Namespace, clusterWrapper.ClusterRoles)
+		} else {
+			logger.Debug(ctx, "Start workloads of helm release [%+v]", taskDirective.ClusterName)
+			err = kubeHandler.StartWorkloads(taskDirective.Namespace, clusterWrapper.ClusterRoles)
+		}
+		if err != nil {
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
+		}
 	case constants.ActionDeleteClusters:
 		err = helmHandler.DeleteRelease(taskDirective.ClusterName, false)
 		if err != nil {
-			return nil, err
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
 		}
 	case constants.ActionCeaseClusters:
 		err = helmHandler.DeleteRelease(taskDirective.ClusterName, true)
 		if err != nil {
-			return nil, err
+			return nil, newTaskError(ctx, task, taskDirective.ClusterName, err)
 		}
 	default:
 		return nil, fmt.Errorf("the task action [%s] is not supported", task.TaskAction)
@@ -269,13 +528,36 @@ func (p *Server) WaitSubtask(ctx context.Context, req *pb.WaitSubtaskRequest) (*
 
 	helmHandler := GetHelmHandler(ctx, taskDirective.RuntimeId)
 
+	defer releaseTasks.Remove(task.TaskId)
+
 	err = funcutil.WaitForSpecificOrError(func() (bool, error) {
 		switch task.TaskAction {
-		case constants.ActionCreateCluster:
-			fallthrough
-		case constants.ActionUpgradeCluster:
+		case constants.ActionCreateCluster, constants.ActionUpgradeCluster,
+			constants.ActionResizeCluster, constants.ActionAddClusterNodes, constants.ActionDeleteClusterNodes:
+			// the task is not tracked when the provider restarted after HandleSubtask, the release tells the outcome then
+			state, ok := releaseTasks.Get(task.TaskId)
+			if ok {
+				if !state.Done {
+					return false, nil
+				}
+				if state.Err != nil {
+					logger.Debug(ctx, "Helm release [%s] failed: %+v", taskDirective.ClusterName, state.Err)
+					return true, state.Err
+				}
+			} else if task.TaskAction != constants.ActionCreateCluster {
+				rlss, err := helmHandler.ReleaseHistory(taskDirective.ClusterName)
+				if err != nil {
+					if _, ok := err.(transport.ConnectionError); ok {
+						return false, nil
+					}
+					return true, err
+				}
+				if reason := getRevertedReason(rlss); reason != "" {
+					return true, fmt.Errorf("release has been rolled back: %s", reason)
+				}
+			}
 			fallthrough
-		case constants.ActionRollbackCluster:
+		case constants.ActionRollbackCluster, constants.ActionRecoverClusters:
 			resp, err := helmHandler.ReleaseStatus(taskDirective.ClusterName)
 			if err != nil {
 				if _, ok := err.(transport.ConnectionError); ok {
@@ -284,11 +566,11 @@ func (p *Server) WaitSubtask(ctx context.Context, req *pb.WaitSubtaskRequest) (*
 				return true, err
 			}
 
-			switch resp.Info.Status.Code {
-			case release.Status_FAILED:
+			switch resp.Info.Status {
+			case release.StatusFailed:
 				logger.Debug(ctx, "Helm release gone to failed")
-				return true, fmt.Errorf("release failed")
-			case release.Status_DEPLOYED:
+				return true, fmt.Errorf("release failed: %s", resp.Info.Description)
+			case release.StatusDeployed:
 				clusterWrapper, err := models.NewClusterWrapper(ctx, taskDirective.RawClusterWrapper)
 				if err != nil {
 					return true, err
@@ -308,45 +590,121 @@ func (p *Server) WaitSubtask(ctx context.Context, req *pb.WaitSubtaskRequest) (*
 
 				return true, nil
 			}
+		case ActionTestCluster:
+			state, ok := releaseTasks.Get(task.TaskId)
+			if ok && !state.Done {
+				return false, nil
+			}
+
+			resp, err := helmHandler.ReleaseStatus(taskDirective.ClusterName)
+			if err != nil {
+				if _, ok := err.(transport.ConnectionError); ok {
+					return false, nil
+				}
+				return true, err
+			}
+
+			results := getReleaseTestResults(resp)
+			for _, result := range results {
+				// the test is still running when it was started before the provider restarted
+				if !ok && result.Phase == release.HookPhaseRunning.String() {
+					return false, nil
+				}
+			}
+
+			kubeHandler := GetKubeHandler(ctx, taskDirective.RuntimeId)
+			for _, result := range results {
+				if result.Kind == "Pod" {
+					result.Log, err = kubeHandler.GetPodLog(taskDirective.Namespace, result.Name)
+					if err != nil {
+						logger.Warn(ctx, "Get log of test pod [%s] failed: %+v", result.Name, err)
+					}
+				}
+				if result.Phase != release.HookPhaseSucceeded.String() {
+					logger.Debug(ctx, "Test [%s] of helm release [%s] %s, log: %s", result.Name, taskDirective.ClusterName, result.Phase, result.Log)
+				}
+			}
+			taskDirective.TestResults = results
+			task.Directive = encodeTaskDirective(taskDirective)
+
+			testErr := getTestError(state.Err, results)
+
+			if testErr != nil {
+				logger.Debug(ctx, "Helm release [%s] test failed: %+v", taskDirective.ClusterName, testErr)
+				if taskDirective.RollbackOnTestFailure {
+					err = helmHandler.RollbackRelease(taskDirective.ClusterName, 0)
+					if err != nil {
+						return true, fmt.Errorf("release test failed: %s, rollback failed: %s", testErr, err)
+					}
+					return true, fmt.Errorf("release test failed and has been rolled back: %s", testErr)
+				}
+				return true, fmt.Errorf("release test failed: %s", testErr)
+			}
+			return true, nil
+		case constants.ActionStopClusters, constants.ActionStartClusters:
+			clusterWrapper, err := models.NewClusterWrapper(ctx, taskDirective.RawClusterWrapper)
+			if err != nil {
+				return true, err
+			}
+
+			kubeHandler := GetKubeHandler(ctx, taskDirective.RuntimeId)
+			if task.TaskAction == constants.ActionStopClusters {
+				err = kubeHandler.WaitWorkloadStopped(
+					taskDirective.Namespace,
+					clusterWrapper.ClusterRoles,
+					task.GetTimeout(constants.WaitTaskTimeout),
+					constants.WaitTaskInterval,
+				)
+			} else {
+				err = kubeHandler.WaitWorkloadStarted(
+					taskDirective.Namespace,
+					clusterWrapper.ClusterRoles,
+					task.GetTimeout(constants.WaitTaskTimeout),
+					constants.WaitTaskInterval,
+				)
+			}
+			return true, err
 		case constants.ActionDeleteClusters:
+			// the history of a deleted release is kept to recover it
 			resp, err := helmHandler.ReleaseStatus(taskDirective.ClusterName)
 			if err != nil {
 				if _, ok := err.(transport.ConnectionError); ok {
 					return false, nil
 				}
 				if strings.Contains(err.Error(), "not found") {
-					logger.Warn(nil, "Waiting on a helm release not existed, %+v", err)
+					logger.Warn(ctx, "Helm release [%s] deleted without history, it cannot be recovered: %+v", taskDirective.ClusterName, err)
 					return true, nil
 				}
 				return true, err
 			}
 
-			if resp.Info.Status.Code == release.Status_DELETED {
+			if resp.Info.Status == release.StatusUninstalled {
 				return true, nil
 			}
 		case constants.ActionCeaseClusters:
+			// the release is ceased when its history is gone
 			_, err := helmHandler.ReleaseStatus(taskDirective.ClusterName)
 			if err != nil {
 				if _, ok := err.(transport.ConnectionError); ok {
 					return false, nil
 				}
 				if strings.Contains(err.Error(), "not found") {
-					logger.Warn(nil, "Waiting on a helm release not existed, %+v", err)
 					return true, nil
 				}
-				return true, nil
+				return true, err
 			}
 		}
 		return false, nil
 	}, task.GetTimeout(constants.WaitHelmTaskTimeout), constants.WaitTaskInterval)
 
+	// the task is returned with the error as well, with the results of the tests in its directive
+	resp := &pb.WaitSubtaskResponse{
+		Task: models.TaskToPb(task),
+	}
 	if err != nil {
-		return nil, err
-	} else {
-		return &pb.WaitSubtaskResponse{
-			Task: models.TaskToPb(task),
-		}, nil
+		return resp, newTaskError(ctx, task, taskDirective.ClusterName, err)
 	}
+	return resp, nil
 }
 
 func (p *Server) DescribeSubnets(ctx context.Context, req *pb.DescribeSubnetsRequest) (*pb.DescribeSubnetsResponse, error) {
@@ -364,11 +722,65 @@ func (p *Server) CheckResource(ctx context.Context, req *pb.CheckResourceRequest
 		return &pb.CheckResourceResponse{
 			Ok: pbutil.ToProtoBool(false),
 		}, err
-	} else {
+	}
+
+	kubeHandler := GetKubeHandler(ctx, cluster.Cluster.RuntimeId)
+	err = kubeHandler.CheckResourceQuota(cluster.Cluster.Zone, cluster)
+	if err != nil {
+		logger.Error(ctx, "Cluster [%s] does not fit in resource quotas of runtime [%s]: %+v",
+			cluster.Cluster.Name, cluster.Cluster.RuntimeId, err)
 		return &pb.CheckResourceResponse{
-			Ok: pbutil.ToProtoBool(true),
-		}, nil
+			Ok: pbutil.ToProtoBool(false),
+		}, err
+	}
+
+	err = checkManifestPolicy(ctx, cluster)
+	if err != nil {
+		logger.Error(ctx, "Cluster [%s] violates manifest policy of runtime [%s]: %+v",
+			cluster.Cluster.Name, cluster.Cluster.RuntimeId, err)
+		return &pb.CheckResourceResponse{
+			Ok: pbutil.ToProtoBool(false),
+		}, err
 	}
+
+	return &pb.CheckResourceResponse{
+		Ok: pbutil.ToProtoBool(true),
+	}, nil
+}
+
+// checkManifestPolicy parses the cluster again from its values, which rejects the manifests violating
+// the manifest policy of the runtime in case the policy is changed since the cluster conf is parsed
+func checkManifestPolicy(ctx context.Context, cluster *models.ClusterWrapper) error {
+	runtimeId := cluster.Cluster.RuntimeId
+	if NewManifestPolicy(ctx, runtimeId) == nil {
+		return nil
+	}
+
+	conf, err := ConvertJsonToYaml([]byte(cluster.Cluster.Env))
+	if err != nil {
+		return err
+	}
+
+	c, appId, provenance, err := getResolvedChartAndAppId(ctx, cluster.Cluster.VersionId, runtimeId, conf)
+	if err != nil {
+		return err
+	}
+
+	runtime, err := runtimeclient.NewRuntime(ctx, runtimeId)
+	if err != nil {
+		return err
+	}
+
+	parser := Parser{
+		ctx:        ctx,
+		Chart:      c,
+		Conf:       string(conf),
+		VersionId:  cluster.Cluster.VersionId,
+		RuntimeId:  runtimeId,
+		Namespace:  runtime.Zone,
+		Provenance: provenance,
+	}
+	return parser.Parse(new(models.ClusterWrapper), appId)
 }
 
 func (p *Server) DescribeVpc(ctx context.Context, req *pb.DescribeVpcRequest) (*pb.DescribeVpcResponse, error) {
@@ -379,6 +791,10 @@ func (p *Server) DescribeClusterDetails(ctx context.Context, req *pb.DescribeClu
 	cluster := models.PbToClusterWrapper(req.GetCluster())
 	kubeHandler := GetKubeHandler(ctx, cluster.Cluster.RuntimeId)
 	err := kubeHandler.DescribeClusterDetails(cluster)
+	if err == nil {
+		helmHandler := GetHelmHandler(ctx, cluster.Cluster.RuntimeId)
+		err = helmHandler.DescribeReleaseHistory(cluster.Cluster)
+	}
 	return &pb.DescribeClusterDetailsResponse{
 		Cluster: models.ClusterWrapperToPb(cluster),
 	}, err
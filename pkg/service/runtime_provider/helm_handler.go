@@ -8,9 +8,13 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"helm.sh/helm/pkg/action"
 	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chartutil"
 	rls "helm.sh/helm/pkg/release"
 
 	"google.golang.org/grpc/transport"
@@ -18,7 +22,10 @@ import (
 	runtimeclient "openpitrix.io/openpitrix/pkg/client/runtime"
 	"openpitrix.io/openpitrix/pkg/constants"
 	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/models"
 	"openpitrix.io/openpitrix/pkg/util/funcutil"
+	"openpitrix.io/openpitrix/pkg/util/jsonutil"
+	"openpitrix.io/openpitrix/pkg/util/yamlutil"
 )
 
 var (
@@ -26,9 +33,15 @@ var (
 	ClusterNameRegExp = regexp.MustCompile(ClusterNameReg)
 )
 
+// MaxReleaseHistory is the max number of revisions described for a release
+const MaxReleaseHistory = 256
+
 type HelmHandler struct {
 	ctx       context.Context
 	RuntimeId string
+	// actionConfig and namespace are used instead of those of the runtime when set, by the tests
+	actionConfig *action.Configuration
+	namespace    string
 }
 
 func GetHelmHandler(ctx context.Context, runtimeId string) *HelmHandler {
@@ -63,80 +76,265 @@ func GetHelmHandler(ctx context.Context, runtimeId string) *HelmHandler {
 //	return clientset, config, err
 //}
 
-func (p *HelmHandler) InstallReleaseFromChart(c *chart.Chart, ns string, rawVals []byte, releaseName string) error {
+// getActionConfig returns the helm action configuration of the runtime and the runtime zone that all releases live in
+func (p *HelmHandler) getActionConfig() (*action.Configuration, string, error) {
+	if p.actionConfig != nil {
+		return p.actionConfig, p.namespace, nil
+	}
+
 	runtime, err := runtimeclient.NewRuntime(p.ctx, p.RuntimeId)
+	if err != nil {
+		return nil, "", err
+	}
+	namespace := runtime.Zone
+
+	storageOptions := GetRuntimeOptions(p.RuntimeId).GetReleaseStorage()
+	cfg, err := actionConfigs.Get(p.RuntimeId, namespace, runtime.RuntimeCredentialContent, storageOptions)
+	if err != nil {
+		return nil, "", err
+	}
+	return cfg, namespace, nil
+}
+
+// getReleaseValues merges the user values in rawVals over the default values of the chart, without the reserved keys
+func getReleaseValues(c *chart.Chart, rawVals []byte) (map[string]interface{}, error) {
+	customVals, err := chartutil.ReadValues(rawVals)
+	if err != nil {
+		return nil, err
+	}
+
+	return MergeValues(CopyValues(c.Values), getChartValues(customVals)), nil
+}
+
+// checkChartInstallable fails for the charts helm refuses to install
+func checkChartInstallable(c *chart.Chart) error {
+	err := c.Validate()
 	if err != nil {
 		return err
 	}
+	if c.Metadata.Type == "library" {
+		return fmt.Errorf("library chart [%s] is not installable", c.Name())
+	}
+	return nil
+}
+
+// PrepareInstallRelease checks the runtime, the chart and the values of the release and returns the install to run,
+// so that their failures are reported at once rather than by the install running in background.
+// The release is installed atomically, it is uninstalled when it is not ready in timeout.
+// The custom resource definitions in the crds/ of the chart are installed before the templates unless skipCRDs
+func (p *HelmHandler) PrepareInstallRelease(c *chart.Chart, rawVals []byte, releaseName string, skipCRDs bool, timeout time.Duration) (func() error, error) {
+	cfg, namespace, err := p.getActionConfig()
+	if err != nil {
+		return nil, err
+	}
 
-	cfg := NewActionConfig(false, []byte(runtime.RuntimeCredentialContent))
+	err = checkChartInstallable(c)
+	if err != nil {
+		return nil, err
+	}
 
-	installClient := action.NewInstall(cfg)
-	//installClient.ValueOptions.StringValues = []string{}
+	installClient := action.NewInstall(withPostRenderers(cfg, c, getPostRenderers(p.ctx, p.RuntimeId)))
 	installClient.ReleaseName = releaseName
+	installClient.Atomic = true
+	installClient.Wait = true
+	installClient.Timeout = timeout
+	installClient.SkipCRDs = skipCRDs
+	installClient.Namespace = namespace
 
-	//validInstallableChart, err := chartutil.IsChartInstallable(c)
-	//if !validInstallableChart {
-	//	return err
-	//}
-	installClient.Namespace = getNamespace([]byte(runtime.RuntimeCredentialContent))
-	_, err = installClient.Run(c, nil)
-	return err
+	vals, err := getReleaseValues(c, rawVals)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		_, err := installClient.Run(c, vals)
+		return err
+	}, nil
 }
 
-func (p *HelmHandler) UpdateReleaseFromChart(releaseName string, c *chart.Chart, rawVals []byte) error {
-	runtime, err := runtimeclient.NewRuntime(p.ctx, p.RuntimeId)
+// getUpgradeValues prepares the upgrade client and the values of the upgrade according to valuesPolicy
+func getUpgradeValues(cfg *action.Configuration, updateClient *action.Upgrade, releaseName string, c *chart.Chart, rawVals []byte, valuesPolicy string) (map[string]interface{}, error) {
+	switch valuesPolicy {
+	case ValuesPolicyReuse:
+		updateClient.ReuseValues = true
+		return map[string]interface{}{}, nil
+	case ValuesPolicyReset, "":
+		updateClient.ResetValues = true
+		return getReleaseValues(c, rawVals)
+	case ValuesPolicyMerge:
+		customVals, err := chartutil.ReadValues(rawVals)
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := action.NewGet(cfg).Run(releaseName)
+		if err != nil {
+			return nil, err
+		}
+
+		updateClient.ResetValues = true
+		vals := MergeValues(CopyValues(c.Values), CopyValues(current.Config))
+		return MergeValues(vals, getChartValues(customVals)), nil
+	default:
+		return nil, fmt.Errorf("values policy [%s] is not supported", valuesPolicy)
+	}
+}
+
+// PrepareUpdateRelease checks the runtime, the chart and the values of the release and returns the upgrade to run,
+// the release is upgraded atomically, it is rolled back when it is not ready in timeout
+func (p *HelmHandler) PrepareUpdateRelease(releaseName string, c *chart.Chart, rawVals []byte, valuesPolicy string, timeout time.Duration) (func() error, error) {
+	cfg, namespace, err := p.getActionConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkChartInstallable(c)
+	if err != nil {
+		return nil, err
+	}
+
+	updateClient := action.NewUpgrade(withPostRenderers(cfg, c, getPostRenderers(p.ctx, p.RuntimeId)))
+	updateClient.Namespace = namespace
+	updateClient.Atomic = true
+	updateClient.Wait = true
+	updateClient.Timeout = timeout
+
+	vals, err := getUpgradeValues(cfg, updateClient, releaseName, c, rawVals, valuesPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	// the objects of the upgrade are evaluated against the manifest policy ahead, by the upgrade run dry
+	if NewManifestPolicy(p.ctx, p.RuntimeId) != nil {
+		var postRenderers []PostRenderer
+		for _, postRenderer := range getPostRenderers(p.ctx, p.RuntimeId) {
+			// the digests are resolved by the upgrade itself
+			if imageRewriter, ok := postRenderer.(*ImageRewriter); ok {
+				postRenderer = imageRewriter.withoutDigests()
+			}
+			postRenderers = append(postRenderers, postRenderer)
+		}
+		err = dryRunUpgrade(cfg, updateClient, releaseName, c, vals, postRenderers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func() error {
+		_, err := updateClient.Run(releaseName, c, vals)
+		return err
+	}, nil
+}
+
+// dryRunUpgrade runs the upgrade without changing the runtime, with the release and its hooks post rendered
+func dryRunUpgrade(cfg *action.Configuration, updateClient *action.Upgrade, releaseName string, c *chart.Chart, vals map[string]interface{}, postRenderers []PostRenderer) error {
+	postRenderCfg := withPostRenderers(cfg, c, postRenderers)
+	dryRunClient := action.NewUpgrade(postRenderCfg)
+	dryRunClient.Namespace = updateClient.Namespace
+	dryRunClient.ReuseValues = updateClient.ReuseValues
+	dryRunClient.ResetValues = updateClient.ResetValues
+	dryRunClient.DryRun = true
+
+	rel, err := dryRunClient.Run(releaseName, c, CopyValues(vals))
 	if err != nil {
 		return err
 	}
-	cfg := NewActionConfig(false, []byte(runtime.RuntimeCredentialContent))
-	chartReq := &chart.Chart{}
 
-	updateClient := action.NewUpgrade(cfg)
+	// the hooks are post rendered when the release is stored, which the dry run skips
+	if kubeClient, ok := postRenderCfg.KubeClient.(*postRenderKubeClient); ok {
+		return kubeClient.postRenderHooks(rel.Hooks)
+	}
+	return nil
+}
 
-	//validInstallableChart, err := chartutil.IsChartInstallable(chartReq)
-	//if !validInstallableChart {
-	//	return err
-	//}
-	updateClient.Namespace = getNamespace([]byte(runtime.RuntimeCredentialContent))
-	_, err = updateClient.Run(releaseName, chartReq, nil)
-	return err
+// GetResizeValues returns the values resizing the release of chart c to the cluster roles, which are merged over
+// the values of the release by the upgrade. The chart is the one deployed, built again with its subcharts
+func (p *HelmHandler) GetResizeValues(releaseName string, c *chart.Chart, clusterRoles map[string]*models.ClusterRole, resources bool) ([]byte, error) {
+	current, err := p.ReleaseStatus(releaseName)
+	if err != nil {
+		return nil, err
+	}
+	if current.Chart != nil && (current.Chart.Name() != c.Name() || current.Chart.Metadata.Version != c.Metadata.Version) {
+		return nil, fmt.Errorf("chart [%s-%s] is not the chart [%s-%s] of release [%s]",
+			c.Name(), c.Metadata.Version, current.Chart.Name(), current.Chart.Metadata.Version, releaseName)
+	}
+
+	roleValues, err := getRoleValues(c)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := getRoleOverrides(roleValues, releaseName, clusterRoles, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	return yamlutil.Encode(overrides)
 }
 
-func (p *HelmHandler) RollbackRelease(releaseName string) error {
-	runtime, err := runtimeclient.NewRuntime(p.ctx, p.RuntimeId)
+// RollbackRelease rolls the release back to revision, to the previous revision when revision is 0
+func (p *HelmHandler) RollbackRelease(releaseName string, revision int) error {
+	cfg, _, err := p.getActionConfig()
 	if err != nil {
 		return err
 	}
-	cfg := NewActionConfig(false, []byte(runtime.RuntimeCredentialContent))
 
 	rollbackClient := action.NewRollback(cfg)
+	rollbackClient.Version = revision
 
 	err = rollbackClient.Run(releaseName)
 
 	return err
 }
 
+// DeleteRelease uninstalls the release, the history of the release is kept to recover it unless purge
 func (p *HelmHandler) DeleteRelease(releaseName string, purge bool) error {
-	runtime, err := runtimeclient.NewRuntime(p.ctx, p.RuntimeId)
+	cfg, _, err := p.getActionConfig()
 	if err != nil {
 		return err
 	}
-	cfg := NewActionConfig(false, []byte(runtime.RuntimeCredentialContent))
 
 	uninstallClient := action.NewUninstall(cfg)
+	uninstallClient.KeepHistory = !purge
 
 	_, err = uninstallClient.Run(releaseName)
 
 	return err
 }
 
+// RecoverRelease brings the uninstalled release back by rolling back to its last revision
+func (p *HelmHandler) RecoverRelease(releaseName string) error {
+	rlss, err := p.ReleaseHistory(releaseName)
+	if err != nil {
+		return err
+	}
+
+	last := getLastRelease(rlss)
+	if last == nil {
+		return fmt.Errorf("release [%s] not found", releaseName)
+	}
+	if last.Info.Status != rls.StatusUninstalled {
+		return fmt.Errorf("release [%s] is %s, only uninstalled release can be recovered", releaseName, last.Info.Status)
+	}
+
+	return p.RollbackRelease(releaseName, last.Version)
+}
+
+func getLastRelease(rlss []*rls.Release) *rls.Release {
+	var last *rls.Release
+	for _, r := range rlss {
+		if last == nil || r.Version > last.Version {
+			last = r
+		}
+	}
+	return last
+}
+
 func (p *HelmHandler) ReleaseStatus(releaseName string) (*rls.Release, error) {
-	runtime, err := runtimeclient.NewRuntime(p.ctx, p.RuntimeId)
+	cfg, _, err := p.getActionConfig()
 	if err != nil {
 		return nil, err
 	}
-	cfg := NewActionConfig(false, []byte(runtime.RuntimeCredentialContent))
 
 	statusClient := action.NewStatus(cfg)
 
@@ -148,6 +346,159 @@ func (p *HelmHandler) ReleaseStatus(releaseName string) (*rls.Release, error) {
 	return release, nil
 }
 
+type ReleaseTestResult struct {
+	Name        string
+	Kind        string
+	Phase       string
+	StartedAt   time.Time
+	CompletedAt time.Time
+	Log         string
+}
+
+// PrepareTestRelease checks the runtime and returns the run of the test hooks of the release
+func (p *HelmHandler) PrepareTestRelease(releaseName string, timeout time.Duration) (func() error, error) {
+	cfg, _, err := p.getActionConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	testClient := action.NewReleaseTesting(cfg)
+	testClient.Timeout = timeout
+
+	return func() error {
+		return testClient.Run(releaseName)
+	}, nil
+}
+
+// getReleaseTestResults returns the last run of the test hooks of the release
+func getReleaseTestResults(r *rls.Release) []*ReleaseTestResult {
+	results := []*ReleaseTestResult{}
+	for _, h := range r.Hooks {
+		for _, e := range h.Events {
+			if e != rls.HookTest {
+				continue
+			}
+			results = append(results, &ReleaseTestResult{
+				Name:        h.Name,
+				Kind:        h.Kind,
+				Phase:       h.LastRun.Phase.String(),
+				StartedAt:   h.LastRun.StartedAt,
+				CompletedAt: h.LastRun.CompletedAt,
+			})
+		}
+	}
+	return results
+}
+
+// MaxTestErrorLogBytes is the max size of the tail of the log of a failed test appended to the error of the tests
+const MaxTestErrorLogBytes = 512
+
+// getTestError returns the error of the tests with the tail of the log of every failed test, which is err when all succeeded
+func getTestError(err error, results []*ReleaseTestResult) error {
+	for _, result := range results {
+		if result.Phase == rls.HookPhaseSucceeded.String() {
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("test [%s] %s", result.Name, strings.ToLower(result.Phase))
+		}
+		if result.Log != "" {
+			log := result.Log
+			if len(log) > MaxTestErrorLogBytes {
+				log = "..." + log[len(log)-MaxTestErrorLogBytes:]
+			}
+			err = fmt.Errorf("%s, log of test [%s]: %s", err, result.Name, log)
+		}
+	}
+	return err
+}
+
+func (p *HelmHandler) ReleaseHistory(releaseName string) ([]*rls.Release, error) {
+	cfg, _, err := p.getActionConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	historyClient := action.NewHistory(cfg)
+	historyClient.Max = MaxReleaseHistory
+
+	return historyClient.Run(releaseName)
+}
+
+// getReleaseHistory returns the revisions of the release from the latest to the oldest
+func getReleaseHistory(rlss []*rls.Release) []map[string]interface{} {
+	sort.Slice(rlss, func(i, j int) bool {
+		return rlss[i].Version > rlss[j].Version
+	})
+
+	history := []map[string]interface{}{}
+	for _, r := range rlss {
+		revision := map[string]interface{}{
+			"revision": r.Version,
+		}
+		if r.Chart != nil && r.Chart.Metadata != nil {
+			revision["chart_version"] = r.Chart.Metadata.Version
+			revision["app_version"] = r.Chart.Metadata.AppVersion
+		}
+		if r.Info != nil {
+			revision["status"] = r.Info.Status.String()
+			revision["updated"] = r.Info.LastDeployed
+			revision["description"] = r.Info.Description
+		}
+		history = append(history, revision)
+	}
+	return history
+}
+
+// getRevertedReason returns why the latest upgrade of the release was rolled back, empty if it was not
+func getRevertedReason(rlss []*rls.Release) string {
+	sort.Slice(rlss, func(i, j int) bool {
+		return rlss[i].Version > rlss[j].Version
+	})
+	if len(rlss) < 2 || rlss[0].Info == nil || rlss[1].Info == nil {
+		return ""
+	}
+	if !strings.HasPrefix(rlss[0].Info.Description, "Rollback to") || rlss[1].Info.Status != rls.StatusFailed {
+		return ""
+	}
+	return rlss[1].Info.Description
+}
+
+// DescribeReleaseHistory adds the revisions of the release and the provenance of the chart deployed into the additional info of the cluster
+func (p *HelmHandler) DescribeReleaseHistory(cluster *models.Cluster) error {
+	rlss, err := p.ReleaseHistory(cluster.Name)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil
+		}
+		return err
+	}
+
+	additionalInfo := make(map[string][]map[string]interface{})
+	if len(cluster.AdditionalInfo) > 0 {
+		err = jsonutil.Decode([]byte(cluster.AdditionalInfo), &additionalInfo)
+		if err != nil {
+			return err
+		}
+	}
+	additionalInfo["history"] = getReleaseHistory(rlss)
+	// the provenance of the chart deployed, which changes by upgrade and rollback
+	for _, r := range rlss {
+		if r.Info == nil || r.Info.Status != rls.StatusDeployed {
+			continue
+		}
+		if provenance := getChartProvenance(r.Chart); provenance != nil {
+			additionalInfo["provenance"] = getProvenanceInfo(provenance)
+		} else {
+			delete(additionalInfo, "provenance")
+		}
+		break
+	}
+
+	(*cluster).AdditionalInfo = jsonutil.ToString(additionalInfo)
+	return nil
+}
+
 func (p *HelmHandler) CheckClusterNameIsUnique(clusterName string) error {
 	if clusterName == "" {
 		return fmt.Errorf("cluster name must be provided")
@@ -168,6 +519,9 @@ func (p *HelmHandler) CheckClusterNameIsUnique(clusterName string) error {
 			if _, ok := err.(transport.ConnectionError); ok {
 				return false, nil
 			}
+			if gerr.IsGRPCError(err) {
+				return true, err
+			}
 			return true, nil
 		}
 
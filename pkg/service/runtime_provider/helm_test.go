@@ -1 +1,785 @@
+// Copyright 2018 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
 package runtime_provider
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"helm.sh/helm/pkg/action"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chartutil"
+	"helm.sh/helm/pkg/kube"
+	kubefake "helm.sh/helm/pkg/kube/fake"
+	"helm.sh/helm/pkg/release"
+	"helm.sh/helm/pkg/storage"
+	"helm.sh/helm/pkg/storage/driver"
+
+	"openpitrix.io/openpitrix/pkg/constants"
+	"openpitrix.io/openpitrix/pkg/models"
+)
+
+const testConfigMapTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+data:
+  image: {{ .Values.image.repository }}:{{ .Values.image.tag }}
+  replicas: "{{ .Values.replicas }}"
+`
+
+func newTestChart() *chart.Chart {
+	return &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV1,
+			Name:       "test",
+			Version:    "0.1.0",
+		},
+		Templates: []*chart.File{
+			{Name: "templates/configmap.yaml", Data: []byte(testConfigMapTemplate)},
+		},
+		Values: map[string]interface{}{
+			"image": map[string]interface{}{
+				"repository": "nginx",
+				"tag":        "1.15",
+			},
+			"replicas": 1,
+		},
+	}
+}
+
+func newTestActionConfig() *action.Configuration {
+	return &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   &kubefake.PrintingKubeClient{Out: ioutil.Discard},
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(format string, v ...interface{}) {},
+	}
+}
+
+// newTestHelmHandler returns the helm handler running the actions by cfg in the default namespace
+func newTestHelmHandler(cfg *action.Configuration) *HelmHandler {
+	helmHandler := GetHelmHandler(context.Background(), "runtime-test")
+	helmHandler.actionConfig = cfg
+	helmHandler.namespace = "default"
+	return helmHandler
+}
+
+func TestGetReleaseValues(t *testing.T) {
+	c := newTestChart()
+
+	rawVals, err := ConvertJsonToYaml([]byte(`{"Name":"test","ValuesPolicy":"merge","SkipCRDs":true,"image":{"tag":"1.17"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals, err := getReleaseValues(c, rawVals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := vals["image"].(map[string]interface{})
+	if image["tag"] != "1.17" {
+		t.Errorf("expected image tag [1.17], got [%v]", image["tag"])
+	}
+	if image["repository"] != "nginx" {
+		t.Errorf("expected image repository [nginx], got [%v]", image["repository"])
+	}
+	for _, key := range []string{"Name", ValuesPolicyKey, SkipCRDsKey} {
+		if _, ok := vals[key]; ok {
+			t.Errorf("expected reserved key [%s] not in values, got [%+v]", key, vals)
+		}
+	}
+
+	// the default values of the chart must stay untouched
+	if c.Values["image"].(map[string]interface{})["tag"] != "1.15" {
+		t.Errorf("chart default values were modified")
+	}
+}
+
+func TestInstallAndUpgradeWithValues(t *testing.T) {
+	helmHandler := newTestHelmHandler(newTestActionConfig())
+	c := newTestChart()
+
+	rawVals, err := ConvertJsonToYaml([]byte(`{"Name":"test","image":{"tag":"1.17"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	install, err := helmHandler.PrepareInstallRelease(c, rawVals, "test", false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = install()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rel.Manifest, "image: nginx:1.17") {
+		t.Errorf("expected install manifest to carry overrides, got:\n%s", rel.Manifest)
+	}
+	if _, ok := rel.Config["Name"]; ok {
+		t.Errorf("expected reserved keys kept out of release values, got [%+v]", rel.Config)
+	}
+
+	rawVals, err = ConvertJsonToYaml([]byte(`{"image":{"tag":"1.17"},"replicas":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := helmHandler.PrepareUpdateRelease("test", c, rawVals, ValuesPolicyReset, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err = helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != 2 || !strings.Contains(rel.Manifest, `replicas: "3"`) || !strings.Contains(rel.Manifest, "image: nginx:1.17") {
+		t.Errorf("expected upgrade manifest to carry overrides, got revision [%d]:\n%s", rel.Version, rel.Manifest)
+	}
+}
+
+func TestUpgradeValuesPolicy(t *testing.T) {
+	cfg := newTestActionConfig()
+	c := newTestChart()
+
+	rawVals, err := ConvertJsonToYaml([]byte(`{"image":{"tag":"1.17"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, err := getReleaseValues(c, rawVals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	installClient := action.NewInstall(cfg)
+	installClient.ReleaseName = "test"
+	installClient.Namespace = "default"
+	_, err = installClient.Run(c, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawVals, err = ConvertJsonToYaml([]byte(`{"replicas":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for policy, expected := range map[string][]string{
+		ValuesPolicyReuse: {"image: nginx:1.17", `replicas: "1"`},
+		ValuesPolicyReset: {"image: nginx:1.15", `replicas: "3"`},
+		ValuesPolicyMerge: {"image: nginx:1.17", `replicas: "3"`},
+	} {
+		upgradeClient := action.NewUpgrade(cfg)
+		upgradeClient.Namespace = "default"
+		vals, err := getUpgradeValues(cfg, upgradeClient, "test", newTestChart(), rawVals, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upgradeClient.DryRun = true
+		rel, err := upgradeClient.Run("test", newTestChart(), vals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range expected {
+			if !strings.Contains(rel.Manifest, s) {
+				t.Errorf("expected manifest of values policy [%s] to contain [%s], got:\n%s", policy, s, rel.Manifest)
+			}
+		}
+	}
+
+	_, err = getUpgradeValues(cfg, action.NewUpgrade(cfg), "test", c, rawVals, "unknown")
+	if err == nil {
+		t.Errorf("expected error for unknown values policy")
+	}
+}
+
+func TestRollbackToRevision(t *testing.T) {
+	cfg := newTestActionConfig()
+	helmHandler := newTestHelmHandler(cfg)
+
+	installClient := action.NewInstall(cfg)
+	installClient.ReleaseName = "test"
+	installClient.Namespace = "default"
+	_, err := installClient.Run(newTestChart(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range []string{"1.16", "1.17"} {
+		upgradeClient := action.NewUpgrade(cfg)
+		upgradeClient.Namespace = "default"
+		_, err = upgradeClient.Run("test", newTestChart(), map[string]interface{}{
+			"image": map[string]interface{}{"tag": tag},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = helmHandler.RollbackRelease("test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != 4 || !strings.Contains(rel.Manifest, "image: nginx:1.15") {
+		t.Errorf("expected revision [4] rolled back to revision [1], got revision [%d]:\n%s", rel.Version, rel.Manifest)
+	}
+
+	// revision 0 is the previous revision
+	err = helmHandler.RollbackRelease("test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err = helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != 5 || !strings.Contains(rel.Manifest, "image: nginx:1.17") {
+		t.Errorf("expected revision [5] rolled back to revision [3], got revision [%d]:\n%s", rel.Version, rel.Manifest)
+	}
+
+	rlss, err := helmHandler.ReleaseHistory("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := getReleaseHistory(rlss)
+	if len(history) != 5 {
+		t.Fatalf("expected [5] revisions, got [%d]", len(history))
+	}
+	if history[0]["revision"] != 5 || history[0]["status"] != "deployed" || history[0]["chart_version"] != "0.1.0" {
+		t.Errorf("unexpected latest revision [%+v]", history[0])
+	}
+	if history[4]["revision"] != 1 || history[4]["status"] != "superseded" {
+		t.Errorf("unexpected oldest revision [%+v]", history[4])
+	}
+}
+
+func TestDeleteRecoverAndCease(t *testing.T) {
+	cfg := newTestActionConfig()
+	helmHandler := newTestHelmHandler(cfg)
+
+	installClient := action.NewInstall(cfg)
+	installClient.ReleaseName = "test"
+	installClient.Namespace = "default"
+	_, err := installClient.Run(newTestChart(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the uninstalled release can be recovered
+	err = helmHandler.RecoverRelease("test")
+	if err == nil || !strings.Contains(err.Error(), "only uninstalled release can be recovered") {
+		t.Errorf("expected deployed release not recovered, got [%+v]", err)
+	}
+
+	// delete keeps the history
+	err = helmHandler.DeleteRelease("test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Info.Status != release.StatusUninstalled {
+		t.Errorf("expected status [%s], got [%s]", release.StatusUninstalled, rel.Info.Status)
+	}
+
+	// recover rolls back to the last uninstalled revision
+	err = helmHandler.RecoverRelease("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err = helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != 2 || rel.Info.Status != release.StatusDeployed || !strings.Contains(rel.Manifest, "image: nginx:1.15") {
+		t.Errorf("expected revision [2] recovered, got revision [%d] [%s]", rel.Version, rel.Info.Status)
+	}
+
+	// cease purges the history
+	err = helmHandler.DeleteRelease("test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = helmHandler.ReleaseStatus("test")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected release not found, got [%+v]", err)
+	}
+	err = helmHandler.RecoverRelease("test")
+	if err == nil {
+		t.Errorf("expected ceased release not recovered")
+	}
+}
+
+func TestGetRoleOverrides(t *testing.T) {
+	c := newTestChart()
+	_, err := getRoleValues(c)
+	if err == nil {
+		t.Errorf("expected error for chart without values of cluster roles")
+	}
+
+	c.Values[RoleValuesKey] = map[string]interface{}{
+		"web-Deployment": map[string]interface{}{"replicas": "web.replicaCount"},
+	}
+	roleValues, err := getRoleValues(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roleValues["web-Deployment"].Replicas != "web.replicaCount" {
+		t.Errorf("unexpected role values from values [%+v]", roleValues["web-Deployment"])
+	}
+
+	// the annotation takes precedence over the values
+	c.Metadata.Annotations = map[string]string{RoleValuesAnnotationKey: `
+web-Deployment:
+  replicas: replicaCount
+  cpu: resources.requests.cpu
+  memory: resources.requests.memory
+agent-DaemonSet:
+  cpu: agent.resources.requests.cpu
+`}
+	roleValues, err = getRoleValues(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusterRoles := map[string]*models.ClusterRole{
+		"test-web-Deployment":  {Role: "test-web-Deployment", Replicas: 3, Cpu: 2, Memory: 4},
+		"test-agent-DaemonSet": {Role: "test-agent-DaemonSet", Replicas: 1, Cpu: 1},
+		"test-db-StatefulSet":  {Role: "test-db-StatefulSet", Replicas: 1, Cpu: 1},
+	}
+	overrides, err := getRoleOverrides(roleValues, "test", clusterRoles, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"replicaCount": uint32(3)}
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("expected overrides %v, got %v", expected, overrides)
+	}
+
+	overrides, err = getRoleOverrides(roleValues, "test", clusterRoles, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{
+		"replicaCount": uint32(3),
+		"resources": map[string]interface{}{
+			"requests": map[string]interface{}{"cpu": "2", "memory": "4Gi"},
+		},
+		"agent": map[string]interface{}{
+			"resources": map[string]interface{}{
+				"requests": map[string]interface{}{"cpu": "1"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("expected overrides %v, got %v", expected, overrides)
+	}
+
+	_, err = getRoleOverrides(roleValues, "test", map[string]*models.ClusterRole{
+		"test-db-StatefulSet": clusterRoles["test-db-StatefulSet"],
+	}, true)
+	if err == nil {
+		t.Errorf("expected error for cluster roles without values")
+	}
+}
+
+func TestResizeWithSubchart(t *testing.T) {
+	helmHandler := newTestHelmHandler(newTestActionConfig())
+	c := newTestChart()
+	c.Values[RoleValuesKey] = map[string]interface{}{
+		"web-Deployment": map[string]interface{}{"replicas": "replicas"},
+	}
+	c.AddDependency(newTestSubchart("redis", "0.1.0"))
+
+	install, err := helmHandler.PrepareInstallRelease(c, nil, "test", false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = install()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the chart of the cluster is built again, the chart kept in the release has lost its subcharts
+	c = newTestChart()
+	c.Values[RoleValuesKey] = map[string]interface{}{
+		"web-Deployment": map[string]interface{}{"replicas": "replicas"},
+	}
+	c.AddDependency(newTestSubchart("redis", "0.1.0"))
+	clusterRoles := map[string]*models.ClusterRole{
+		"test-web-Deployment": {Role: "test-web-Deployment", Replicas: 3},
+	}
+	rawVals, err := helmHandler.GetResizeValues("test", c, clusterRoles, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := helmHandler.PrepareUpdateRelease("test", c, rawVals, ValuesPolicyMerge, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rel.Manifest, `replicas: "3"`) || !strings.Contains(rel.Manifest, "image: redis:0.1.0") {
+		t.Errorf("expected resized manifest to keep the subchart, got:\n%s", rel.Manifest)
+	}
+
+	c.Metadata.Version = "0.2.0"
+	_, err = helmHandler.GetResizeValues("test", c, clusterRoles, false)
+	if err == nil {
+		t.Errorf("expected error for chart of another version than the release")
+	}
+}
+
+const testServiceTemplate = `apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .Release.Name }}
+spec:
+  type: {{ .Values.serviceType }}
+  ports:
+  - port: 80
+`
+
+func TestUpgradeManifestPolicy(t *testing.T) {
+	defer SetProviderOptions(new(ProviderOptions))
+	SetProviderOptions(&ProviderOptions{
+		Runtimes: map[string]*RuntimeOptions{"runtime-test": {
+			ManifestPolicy: &ManifestPolicyOptions{DeniedServiceTypes: []string{"LoadBalancer"}},
+		}},
+	})
+
+	helmHandler := newTestHelmHandler(newTestActionConfig())
+	c := newTestChart()
+	c.Templates = append(c.Templates, &chart.File{Name: "templates/service.yaml", Data: []byte(testServiceTemplate)})
+	c.Values["serviceType"] = "ClusterIP"
+
+	install, err := helmHandler.PrepareInstallRelease(c, nil, "test", false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = install()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the upgrade violating the policy is rejected before it runs
+	rawVals, err := ConvertJsonToYaml([]byte(`{"serviceType":"LoadBalancer"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = helmHandler.PrepareUpdateRelease("test", c, rawVals, ValuesPolicyMerge, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "Service/test") {
+		t.Errorf("expected upgrade violating manifest policy to fail, got [%+v]", err)
+	}
+	rel, err := helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != 1 {
+		t.Errorf("expected release not upgraded, got revision [%d]", rel.Version)
+	}
+
+	rawVals, err = ConvertJsonToYaml([]byte(`{"serviceType":"NodePort"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := helmHandler.PrepareUpdateRelease("test", c, rawVals, ValuesPolicyMerge, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err = helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Version != 2 || !strings.Contains(rel.Manifest, "type: NodePort") {
+		t.Errorf("expected release upgraded, got revision [%d]:\n%s", rel.Version, rel.Manifest)
+	}
+}
+
+func TestGetIntFromValues(t *testing.T) {
+	vals := map[string]interface{}{
+		"number": float64(3),
+		"string": "4",
+		"float":  3.5,
+		"text":   "latest",
+	}
+	for key, expected := range map[string]int{"number": 3, "string": 4} {
+		i, ok := GetIntFromValues(vals, key)
+		if !ok || i != expected {
+			t.Errorf("expected [%d] of [%s], got [%d]", expected, key, i)
+		}
+	}
+	for _, key := range []string{"float", "text", "missing"} {
+		if _, ok := GetIntFromValues(vals, key); ok {
+			t.Errorf("expected [%s] not to be an integer", key)
+		}
+	}
+}
+
+// notReadyOnceKubeClient fails the first wait for resources to be ready, and records the timeouts of the waits
+type notReadyOnceKubeClient struct {
+	kubefake.PrintingKubeClient
+	waited   bool
+	timeouts []time.Duration
+}
+
+func (c *notReadyOnceKubeClient) Wait(resources kube.ResourceList, timeout time.Duration) error {
+	c.timeouts = append(c.timeouts, timeout)
+	if !c.waited {
+		c.waited = true
+		return errors.New("timed out waiting for the condition")
+	}
+	return nil
+}
+
+func TestAtomicInstallAndUpgrade(t *testing.T) {
+	kubeClient := &notReadyOnceKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}}
+	cfg := newTestActionConfig()
+	cfg.KubeClient = kubeClient
+	helmHandler := newTestHelmHandler(cfg)
+
+	// the timeout of the task the same as HandleSubtask
+	task := &models.Task{Directive: `{"timeout":90}`}
+	timeout := task.GetTimeout(constants.WaitHelmTaskTimeout)
+
+	install, err := helmHandler.PrepareInstallRelease(newTestChart(), nil, "test", false, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = install()
+	if err == nil {
+		t.Fatalf("expected install to fail")
+	}
+	_, err = helmHandler.ReleaseStatus("test")
+	if err == nil {
+		t.Errorf("expected failed install to be uninstalled")
+	}
+
+	install, err = helmHandler.PrepareInstallRelease(newTestChart(), nil, "test", false, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = install()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient.waited = false
+	rawVals, err := ConvertJsonToYaml([]byte(`{"replicas":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := helmHandler.PrepareUpdateRelease("test", newTestChart(), rawVals, ValuesPolicyReset, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = update()
+	if err == nil {
+		t.Fatalf("expected upgrade to fail")
+	}
+
+	rlss, err := helmHandler.ReleaseHistory("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reason := getRevertedReason(rlss)
+	if !strings.Contains(reason, "timed out waiting for the condition") {
+		t.Errorf("expected reason of the rollback, got [%s]", reason)
+	}
+
+	rel, err := helmHandler.ReleaseStatus("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Info.Status != release.StatusDeployed || !strings.Contains(rel.Manifest, `replicas: "1"`) {
+		t.Errorf("expected release to be rolled back, got [%s]:\n%s", rel.Info.Status, rel.Manifest)
+	}
+
+	// install, upgrade and the rollback all wait for the release in the timeout of the task
+	if len(kubeClient.timeouts) < 3 {
+		t.Errorf("expected the releases waited for, got [%+v]", kubeClient.timeouts)
+	}
+	for _, waited := range kubeClient.timeouts {
+		if waited != 90*time.Second {
+			t.Errorf("expected the releases waited for in [%s], got [%s]", 90*time.Second, waited)
+		}
+	}
+}
+
+func TestReleaseTaskTracker(t *testing.T) {
+	tracker := NewReleaseTaskTracker(time.Minute)
+
+	_, ok := tracker.Get("task-test")
+	if ok {
+		t.Errorf("expected task not to be tracked")
+	}
+
+	finish := make(chan struct{})
+	tracker.Start("task-test", func() error {
+		<-finish
+		return errors.New("release reverted")
+	})
+
+	state, ok := tracker.Get("task-test")
+	if !ok || state.Done {
+		t.Errorf("expected task to be running, got [%+v]", state)
+	}
+
+	close(finish)
+	for i := 0; i < 100 && !state.Done; i++ {
+		time.Sleep(10 * time.Millisecond)
+		state, _ = tracker.Get("task-test")
+	}
+	if !state.Done || state.Err == nil || state.Err.Error() != "release reverted" {
+		t.Errorf("expected task to be done with its error, got [%+v]", state)
+	}
+
+	tracker.Remove("task-test")
+	_, ok = tracker.Get("task-test")
+	if ok {
+		t.Errorf("expected task to be removed")
+	}
+
+	// a panic fails the task instead of the provider
+	tracker.Start("task-panic", func() error {
+		panic("nil chart")
+	})
+	state, _ = tracker.Get("task-panic")
+	for i := 0; i < 100 && !state.Done; i++ {
+		time.Sleep(10 * time.Millisecond)
+		state, _ = tracker.Get("task-panic")
+	}
+	if !state.Done || state.Err == nil || !strings.Contains(state.Err.Error(), "nil chart") {
+		t.Errorf("expected task to be done with the panic as its error, got [%+v]", state)
+	}
+}
+
+func TestCheckChartInstallable(t *testing.T) {
+	library := newTestChart()
+	library.Metadata.Type = "library"
+	invalid := newTestChart()
+	invalid.Metadata.Name = ""
+
+	for _, c := range []*chart.Chart{library, invalid} {
+		if checkChartInstallable(c) == nil {
+			t.Errorf("expected error for chart not installable [%+v]", c.Metadata)
+		}
+	}
+	if err := checkChartInstallable(newTestChart()); err != nil {
+		t.Errorf("expected chart installable, got [%+v]", err)
+	}
+}
+
+const testPodTemplate = `apiVersion: v1
+kind: Pod
+metadata:
+  name: {{ .Release.Name }}-test
+  annotations:
+    "helm.sh/hook": test
+spec:
+  containers:
+  - name: test
+    image: busybox
+    command: ["wget", "{{ .Release.Name }}"]
+  restartPolicy: Never
+`
+
+func TestReleaseTestResults(t *testing.T) {
+	cfg := newTestActionConfig()
+	c := newTestChart()
+	c.Templates = append(c.Templates, &chart.File{Name: "templates/tests/test.yaml", Data: []byte(testPodTemplate)})
+
+	installClient := action.NewInstall(cfg)
+	installClient.ReleaseName = "test"
+	installClient.Namespace = "default"
+	_, err := installClient.Run(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = action.NewReleaseTesting(cfg).Run("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := action.NewGet(cfg).Run("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := getReleaseTestResults(rel)
+	if len(results) != 1 || results[0].Name != "test-test" || results[0].Kind != "Pod" || results[0].Phase != "Succeeded" {
+		t.Errorf("unexpected test results [%+v]", results)
+	}
+
+	cfg.KubeClient = &kubefake.FailingKubeClient{
+		PrintingKubeClient:   kubefake.PrintingKubeClient{Out: ioutil.Discard},
+		WatchUntilReadyError: errors.New("pod test-test failed"),
+	}
+	err = action.NewReleaseTesting(cfg).Run("test")
+	if err == nil {
+		t.Fatalf("expected release test to fail")
+	}
+	rel, err = action.NewGet(cfg).Run("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results = getReleaseTestResults(rel)
+	if len(results) != 1 || results[0].Phase != "Failed" {
+		t.Errorf("unexpected test results [%+v]", results)
+	}
+}
+
+func TestGetTestError(t *testing.T) {
+	err := getTestError(nil, []*ReleaseTestResult{{Name: "test-ok", Phase: "Succeeded", Log: "ok"}})
+	if err != nil {
+		t.Errorf("expected no error of the tests succeeded, got [%+v]", err)
+	}
+
+	log := strings.Repeat("x", MaxTestErrorLogBytes) + "connection refused"
+	err = getTestError(nil, []*ReleaseTestResult{
+		{Name: "test-ok", Phase: "Succeeded", Log: "ok"},
+		{Name: "test-db", Phase: "Failed", Log: log},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "test [test-db] failed, log of test [test-db]: ...") ||
+		!strings.HasSuffix(err.Error(), "connection refused") || strings.Contains(err.Error(), "test-ok") {
+		t.Errorf("expected error of the failed test with the tail of its log, got [%+v]", err)
+	}
+	if len(err.Error()) > len("test [test-db] failed, log of test [test-db]: ...")+MaxTestErrorLogBytes {
+		t.Errorf("expected the log in the error truncated, got [%d] bytes", len(err.Error()))
+	}
+
+	// the error of the test run is kept
+	err = getTestError(errors.New("timed out"), []*ReleaseTestResult{{Name: "test-db", Phase: "Running"}})
+	if err == nil || err.Error() != "timed out" {
+		t.Errorf("expected error of the test run, got [%+v]", err)
+	}
+}
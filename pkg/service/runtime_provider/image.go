@@ -0,0 +1,300 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// podSpecPaths are the paths of the pod spec in the manifests of the workloads by group and kind,
+// the custom resources of the same kinds in other groups are not workloads
+var podSpecPaths = map[schema.GroupKind][]string{
+	{Kind: "Pod"}:                             {"spec"},
+	{Kind: "ReplicationController"}:           {"spec", "template", "spec"},
+	{Group: "apps", Kind: "Deployment"}:       {"spec", "template", "spec"},
+	{Group: "apps", Kind: "StatefulSet"}:      {"spec", "template", "spec"},
+	{Group: "apps", Kind: "DaemonSet"}:        {"spec", "template", "spec"},
+	{Group: "apps", Kind: "ReplicaSet"}:       {"spec", "template", "spec"},
+	{Group: "extensions", Kind: "Deployment"}: {"spec", "template", "spec"},
+	{Group: "extensions", Kind: "DaemonSet"}:  {"spec", "template", "spec"},
+	{Group: "extensions", Kind: "ReplicaSet"}: {"spec", "template", "spec"},
+	{Group: "batch", Kind: "Job"}:             {"spec", "template", "spec"},
+	{Group: "batch", Kind: "CronJob"}:         {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// containerFields are the fields of the containers in the pod spec
+var containerFields = []string{"initContainers", "containers", "ephemeralContainers"}
+
+// ImageRewrite is the image of a container in a workload rewritten by the image rewrite policy
+type ImageRewrite struct {
+	Kind      string
+	Name      string
+	Container string
+	Original  string
+	Image     string
+}
+
+// ImageRewriter rewrites the images of the containers in the manifests by the image rewrite policy of a runtime,
+// the digests are resolved from the registries with the registry credentials of the runtime
+type ImageRewriter struct {
+	ctx      context.Context
+	Options  *ImageRewriteOptions
+	Resolver remotes.Resolver
+
+	digests map[string]string
+}
+
+func NewImageRewriter(ctx context.Context, runtimeId string) *ImageRewriter {
+	options := GetRuntimeOptions(runtimeId)
+	if options.ImageRewrite == nil {
+		return nil
+	}
+	return &ImageRewriter{
+		ctx:      ctx,
+		Options:  options.ImageRewrite,
+		Resolver: newRegistryResolver(options.Registries),
+		digests:  make(map[string]string),
+	}
+}
+
+// withoutDigests returns a copy of the rewriter mapping the registries only
+func (r *ImageRewriter) withoutDigests() *ImageRewriter {
+	options := *r.Options
+	options.PinDigest = false
+
+	rewriter := *r
+	rewriter.Options = &options
+	return &rewriter
+}
+
+// RewriteImage maps the registry of the image by the longest prefix of its normalized reference matching on a boundary,
+// e.g. "nginx:1.15" is "docker.io/library/nginx:1.15", and pins it by digest if required.
+// The image is returned as it is when the policy does not change it
+func (r *ImageRewriter) RewriteImage(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image [%s]: %+v", image, err)
+	}
+	named = reference.TagNameOnly(named)
+
+	rewritten := named.String()
+	var prefix, rest string
+	for from := range r.Options.Registries {
+		if remainder, ok := trimImagePrefix(rewritten, from); ok && len(from) > len(prefix) {
+			prefix, rest = from, remainder
+		}
+	}
+	if prefix != "" {
+		rewritten = strings.TrimSuffix(r.Options.Registries[prefix], "/") + rest
+	}
+
+	if _, ok := named.(reference.Digested); r.Options.PinDigest && !ok {
+		digest, err := r.resolveDigest(rewritten)
+		if err != nil {
+			return "", fmt.Errorf("resolve digest of image [%s] failed: %+v", rewritten, err)
+		}
+		rewritten += "@" + digest
+	} else if prefix == "" {
+		return image, nil
+	}
+
+	_, err = reference.ParseNormalizedNamed(rewritten)
+	if err != nil {
+		return "", fmt.Errorf("image [%s] is rewritten to invalid image [%s]: %+v", image, rewritten, err)
+	}
+	return rewritten, nil
+}
+
+// trimImagePrefix trims the prefix of the registries from the normalized image on a "/" boundary,
+// or on the tag or digest of the image when the prefix is a repository, so "docker.io" does not match "docker.iox/"
+func trimImagePrefix(image, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" || !strings.HasPrefix(image, prefix) {
+		return "", false
+	}
+	rest := image[len(prefix):]
+	if strings.HasPrefix(rest, "/") {
+		return rest, true
+	}
+	if strings.Contains(prefix, "/") && (strings.HasPrefix(rest, ":") || strings.HasPrefix(rest, "@")) {
+		return rest, true
+	}
+	return "", false
+}
+
+func (r *ImageRewriter) resolveDigest(image string) (string, error) {
+	if digest, ok := r.digests[image]; ok {
+		return digest, nil
+	}
+	_, desc, err := r.Resolver.Resolve(r.ctx, image)
+	if err != nil {
+		return "", err
+	}
+	r.digests[image] = desc.Digest.String()
+	return r.digests[image], nil
+}
+
+// rewriteObject rewrites the images of the containers in the object if it is a workload
+func (r *ImageRewriter) rewriteObject(obj map[string]interface{}) ([]ImageRewrite, error) {
+	u := unstructured.Unstructured{Object: obj}
+	podSpecPath, ok := podSpecPaths[u.GroupVersionKind().GroupKind()]
+	if !ok {
+		return nil, nil
+	}
+
+	var rewrites []ImageRewrite
+	for _, field := range containerFields {
+		path := append(append([]string{}, podSpecPath...), field)
+		containers, found, err := unstructured.NestedSlice(obj, path...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s of [%s/%s]: %+v", field, u.GetKind(), u.GetName(), err)
+		}
+		if !found {
+			continue
+		}
+
+		var changed bool
+		for _, c := range containers {
+			container, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			image, ok := container["image"].(string)
+			if !ok || image == "" {
+				continue
+			}
+			rewritten, err := r.RewriteImage(image)
+			if err != nil {
+				return nil, err
+			}
+			if rewritten == image {
+				continue
+			}
+
+			container["image"] = rewritten
+			changed = true
+			name, _ := container["name"].(string)
+			rewrites = append(rewrites, ImageRewrite{
+				Kind:      u.GetKind(),
+				Name:      u.GetName(),
+				Container: name,
+				Original:  image,
+				Image:     rewritten,
+			})
+		}
+		if changed {
+			err = unstructured.SetNestedSlice(obj, containers, path...)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rewrites, nil
+}
+
+// RewriteManifests rewrites the images in the yaml stream of manifests, the documents without images rewritten
+// are kept as they are
+func (r *ImageRewriter) RewriteManifests(manifests []byte) ([]byte, []ImageRewrite, error) {
+	var out bytes.Buffer
+	var rewrites []ImageRewrite
+	reader := k8syaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(manifests)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		var obj map[string]interface{}
+		err = yaml.Unmarshal(doc, &obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		objRewrites, err := r.rewriteObject(obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(objRewrites) > 0 {
+			rewrites = append(rewrites, objRewrites...)
+			doc, err = yaml.Marshal(obj)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		out.WriteString("---\n")
+		out.Write(doc)
+		if !bytes.HasSuffix(doc, []byte("\n")) {
+			out.WriteString("\n")
+		}
+	}
+	return out.Bytes(), rewrites, nil
+}
+
+// Run rewrites the images in the manifests built into the resources
+func (r *ImageRewriter) Run(manifests []byte) ([]byte, error) {
+	out, _, err := r.RewriteManifests(manifests)
+	return out, err
+}
+
+// RewriteFiles rewrites the images in the yaml files rendered by the engine
+func (r *ImageRewriter) RewriteFiles(files map[string]string) (map[string]string, []ImageRewrite, error) {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rewrittenFiles := make(map[string]string)
+	var rewrites []ImageRewrite
+	for _, name := range names {
+		content := files[name]
+		if filepath.Ext(name) != ".yaml" || len(strings.TrimSpace(content)) == 0 {
+			rewrittenFiles[name] = content
+			continue
+		}
+
+		out, fileRewrites, err := r.RewriteManifests([]byte(content))
+		if err != nil {
+			return nil, nil, fmt.Errorf("rewrite images in file [%s] failed: %+v", name, err)
+		}
+		rewrittenFiles[name] = string(out)
+		rewrites = append(rewrites, fileRewrites...)
+	}
+	return rewrittenFiles, rewrites, nil
+}
+
+func getImageInfo(rewrites []ImageRewrite) []map[string]interface{} {
+	info := []map[string]interface{}{}
+	for _, rewrite := range rewrites {
+		// the role is named after the workload the same way as the cluster roles
+		info = append(info, map[string]interface{}{
+			"role":      fmt.Sprintf("%s-%s", rewrite.Name, rewrite.Kind),
+			"container": rewrite.Container,
+			"original":  rewrite.Original,
+			"image":     rewrite.Image,
+		})
+	}
+	return info
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testWorkloads = `# Source: test/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: nginx
+spec:
+  ports:
+  - port: 80
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox
+      containers:
+      - name: nginx
+        image: nginx:1.15
+      - name: exporter
+        image: quay.io/prometheus/nginx-exporter:0.4.2
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: backup
+            image: bitnami/redis:5.0
+`
+
+func TestRewriteImage(t *testing.T) {
+	r := &ImageRewriter{
+		ctx: context.Background(),
+		Options: &ImageRewriteOptions{Registries: map[string]string{
+			"docker.io/":                "mirror.local/",
+			"docker.io/bitnami/":        "mirror.local/charts/",
+			"docker.io/library/busybox": "mirror.local/busybox",
+			"gcr.io":                    "mirror.local/gcr",
+		}},
+		digests: make(map[string]string),
+	}
+
+	for image, expected := range map[string]string{
+		"nginx":                     "mirror.local/library/nginx:latest",
+		"nginx:1.15":                "mirror.local/library/nginx:1.15",
+		"docker.io/library/nginx":   "mirror.local/library/nginx:latest",
+		"bitnami/redis:5.0":         "mirror.local/charts/redis:5.0",
+		"quay.io/coreos/etcd:v3.3":  "quay.io/coreos/etcd:v3.3",
+		"mirror.local/busybox:1.31": "mirror.local/busybox:1.31",
+		"busybox:1.31":              "mirror.local/busybox:1.31",
+		"busybox-extra:1.31":        "mirror.local/library/busybox-extra:1.31",
+		"gcr.io/pause:3.1":          "mirror.local/gcr/pause:3.1",
+		"gcr.iox/pause:3.1":         "gcr.iox/pause:3.1",
+		"docker.iox/nginx:1.15":     "docker.iox/nginx:1.15",
+	} {
+		rewritten, err := r.RewriteImage(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rewritten != expected {
+			t.Errorf("expected image [%s] rewritten to [%s], got [%s]", image, expected, rewritten)
+		}
+	}
+
+	_, err := r.RewriteImage("Nginx:1.15")
+	if err == nil {
+		t.Errorf("expected error for invalid image")
+	}
+}
+
+func TestRewriteImagePinDigest(t *testing.T) {
+	registry := newTestRegistry()
+	manifestDigest, _ := registry.push(t, "library/nginx", "1.15", []byte("nginx"))
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	r := &ImageRewriter{
+		ctx: context.Background(),
+		Options: &ImageRewriteOptions{
+			Registries: map[string]string{"docker.io/": host + "/"},
+			PinDigest:  true,
+		},
+		Resolver: newRegistryResolver([]*RegistryOptions{{Host: host, Username: testRegistryUsername, Password: testRegistryPassword}}),
+		digests:  make(map[string]string),
+	}
+
+	rewritten, err := r.RewriteImage("nginx:1.15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != host+"/library/nginx:1.15@"+manifestDigest.String() {
+		t.Errorf("expected image pinned by digest [%s], got [%s]", manifestDigest, rewritten)
+	}
+
+	// the images pinned already are not resolved
+	pinned := "nginx@" + manifestDigest.String()
+	rewritten, err = r.RewriteImage(pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != host+"/library/"+pinned {
+		t.Errorf("expected digest of image kept, got [%s]", rewritten)
+	}
+
+	_, err = r.RewriteImage("nginx:1.17")
+	if err == nil {
+		t.Errorf("expected error for image not found in registry")
+	}
+
+	// the parse maps the registries only, the digests are resolved by the install or the upgrade
+	rewritten, err = r.withoutDigests().RewriteImage("nginx:1.17")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != host+"/library/nginx:1.17" || !r.Options.PinDigest {
+		t.Errorf("expected image rewritten without digest by a copy of the rewriter, got [%s]", rewritten)
+	}
+}
+
+func TestRewriteManifests(t *testing.T) {
+	r := &ImageRewriter{
+		ctx:     context.Background(),
+		Options: &ImageRewriteOptions{Registries: map[string]string{"docker.io/": "mirror.local/"}},
+		digests: make(map[string]string),
+	}
+
+	out, rewrites, err := r.RewriteManifests([]byte(testWorkloads))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# Source: test/templates/service.yaml",
+		"image: mirror.local/library/busybox:latest",
+		"image: mirror.local/library/nginx:1.15",
+		"image: quay.io/prometheus/nginx-exporter:0.4.2",
+		"image: mirror.local/bitnami/redis:5.0",
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("expected [%s] in rewritten manifests [%s]", expected, out)
+		}
+	}
+
+	info := getImageInfo(rewrites)
+	if len(info) != 3 {
+		t.Fatalf("expected images of init containers and containers reported, got [%+v]", info)
+	}
+	if info[0]["role"] != "nginx-Deployment" || info[0]["container"] != "init" || info[0]["original"] != "busybox" {
+		t.Errorf("unexpected image of init container [%+v]", info[0])
+	}
+	if info[2]["role"] != "backup-CronJob" || info[2]["image"] != "mirror.local/bitnami/redis:5.0" {
+		t.Errorf("unexpected image of cron job [%+v]", info[2])
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	authorizationv1 "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -18,11 +19,13 @@ import (
 	"k8s.io/apimachinery/pkg/version"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/kubernetes"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 
 	runtimeclient "openpitrix.io/openpitrix/pkg/client/runtime"
+	"openpitrix.io/openpitrix/pkg/constants"
 	"openpitrix.io/openpitrix/pkg/gerr"
 	"openpitrix.io/openpitrix/pkg/logger"
 	"openpitrix.io/openpitrix/pkg/models"
@@ -107,7 +110,9 @@ func (p *KubeHandler) DescribeVersionInfo() (*version.Info, error) {
 	return kubeClient.ServerVersion()
 }
 
-func (p *KubeHandler) CheckApiVersionsSupported(apiVersions []string) error {
+// CheckApiVersionsSupported checks the api versions are served by the runtime,
+// or provided by the custom resource definitions installed along with them
+func (p *KubeHandler) CheckApiVersionsSupported(apiVersions []string, providedApiVersions []string) error {
 	if len(apiVersions) == 0 {
 		return nil
 	}
@@ -133,8 +138,11 @@ func (p *KubeHandler) CheckApiVersionsSupported(apiVersions []string) error {
 		}
 	}
 	logger.Debug(p.ctx, "Get runtime [%s] supported versions [%+v]", p.RuntimeId, supportedVersions)
-	logger.Debug(p.ctx, "Check api versions [%+v]", apiVersions)
+	logger.Debug(p.ctx, "Check api versions [%+v] with provided versions [%+v]", apiVersions, providedApiVersions)
 	for _, apiVersion := range apiVersions {
+		if stringutil.StringIn(apiVersion, providedApiVersions) {
+			continue
+		}
 		if !stringutil.StringIn(apiVersion, supportedVersions) {
 			return gerr.New(p.ctx, gerr.PermissionDenied, gerr.ErrorUnsupportedApiVersion, apiVersion)
 		}
@@ -165,6 +173,28 @@ func (p *KubeHandler) WaitWorkloadReady(runtimeId, namespace string, clusterRole
 	return err
 }
 
+// MaxPodLogBytes is the max size of the log read from the tail of a pod
+const MaxPodLogBytes = 4096
+
+// GetPodLog returns the tail of the log of the pod
+func (p *KubeHandler) GetPodLog(namespace, podName string) (string, error) {
+	kubeClient, _, err := p.initKubeClient()
+	if err != nil {
+		return "", err
+	}
+
+	var tailLines int64 = 100
+	var limitBytes int64 = MaxPodLogBytes
+	log, err := kubeClient.CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{
+		TailLines:  &tailLines,
+		LimitBytes: &limitBytes,
+	}).DoRaw()
+	if err != nil {
+		return "", err
+	}
+	return string(log), nil
+}
+
 func (p *KubeHandler) describeAdditionalInfo(namespace string, cluster *models.Cluster) error {
 	kubeClient, _, err := p.initKubeClient()
 	if err != nil {
@@ -274,6 +304,7 @@ func (p *KubeHandler) DescribeClusterDetails(clusterWrapper *models.ClusterWrapp
 	}
 	namespace := runtime.Zone
 
+	workloads, stoppedWorkloads := 0, 0
 	for k, clusterRole := range clusterWrapper.ClusterRoles {
 
 		pods, err := p.getPodsByClusterRole(namespace, clusterRole)
@@ -285,11 +316,24 @@ func (p *KubeHandler) DescribeClusterDetails(clusterWrapper *models.ClusterWrapp
 			continue
 		}
 
+		workloads++
+		stopped, err := p.isWorkloadStopped(namespace, clusterRole)
+		if err != nil {
+			return err
+		}
+		if stopped {
+			stoppedWorkloads++
+		}
+
 		(*clusterWrapper).ClusterRoles[k] = clusterRole
 
 		p.addPodsToClusterNodes(&clusterWrapper.ClusterNodesWithKeyPairs, pods, clusterWrapper.Cluster.ClusterId, clusterWrapper.Cluster.Owner, clusterRole.Role)
 	}
 
+	if workloads > 0 && stoppedWorkloads == workloads {
+		(*clusterWrapper).Cluster.Status = constants.StatusStopped
+	}
+
 	err = p.describeAdditionalInfo(namespace, clusterWrapper.Cluster)
 	if err != nil {
 		return err
@@ -298,18 +342,76 @@ func (p *KubeHandler) DescribeClusterDetails(clusterWrapper *models.ClusterWrapp
 	return nil
 }
 
-func (p *KubeHandler) checkTillerIsExistedAndRunning(client *kubernetes.Clientset, credential, zone string) error {
-	deployCli := client.ExtensionsV1beta1().Deployments("kube-system")
+type resourcePermission struct {
+	Group    string
+	Resource string
+	Verbs    []string
+}
 
-	deploy, err := deployCli.Get("tiller-deploy", metav1.GetOptions{})
-	if err != nil {
-		return gerr.NewWithDetail(nil, gerr.Unavailable, err, gerr.ErrorTillerNotServe, "kube-system")
+var (
+	// releaseStoragePermissions are needed by the release storage drivers keeping releases in the namespace
+	releaseStoragePermissions = map[string]resourcePermission{
+		ReleaseStorageSecrets:    {Resource: "secrets", Verbs: []string{"create", "get", "list", "update", "delete"}},
+		ReleaseStorageConfigMaps: {Resource: "configmaps", Verbs: []string{"create", "get", "list", "update", "delete"}},
+	}
+	// workloadPermissions are needed to deploy the cluster roles parsed from charts
+	workloadPermissions = []resourcePermission{
+		{Group: "apps", Resource: "deployments", Verbs: []string{"create", "get", "patch", "update", "delete"}},
+		{Group: "apps", Resource: "statefulsets", Verbs: []string{"create", "get", "patch", "update", "delete"}},
+		{Group: "apps", Resource: "daemonsets", Verbs: []string{"create", "get", "patch", "update", "delete"}},
+		{Resource: "services", Verbs: []string{"create", "get", "patch", "delete"}},
+		{Resource: "pods", Verbs: []string{"get", "list"}},
+	}
+)
+
+func getRuntimePermissions(storageDriver string) []resourcePermission {
+	var permissions []resourcePermission
+	switch storageDriver {
+	case "secret", ReleaseStorageSecrets, "":
+		permissions = append(permissions, releaseStoragePermissions[ReleaseStorageSecrets])
+	case "configmap", ReleaseStorageConfigMaps:
+		permissions = append(permissions, releaseStoragePermissions[ReleaseStorageConfigMaps])
 	}
+	return append(permissions, workloadPermissions...)
+}
+
+// newPermissionDeniedError returns the error with a detail for every denied permission
+func newPermissionDeniedError(denied []string) error {
+	return newDetailedError(nil, gerr.PermissionDenied, gerr.ErrorPermissionDenied, denied)
+}
+
+// checkPermissions confirms by SelfSubjectAccessReview that the credential can manage the releases in zone
+func (p *KubeHandler) checkPermissions(reviews authorizationv1client.SelfSubjectAccessReviewInterface, zone string, permissions []resourcePermission) error {
+	var denied []string
+	for _, permission := range permissions {
+		for _, verb := range permission.Verbs {
+			review, err := reviews.Create(&authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace: zone,
+						Verb:      verb,
+						Group:     permission.Group,
+						Resource:  permission.Resource,
+					},
+				},
+			})
+			if err != nil {
+				return gerr.NewWithDetail(nil, gerr.PermissionDenied, err, gerr.ErrorPermissionDenied)
+			}
 
-	if deploy.Status.ReadyReplicas != deploy.Status.Replicas {
-		return gerr.NewWithDetail(nil, gerr.Unavailable, err, gerr.ErrorTillerNotServe, "kube-system")
+			if !review.Status.Allowed {
+				resource := permission.Resource
+				if permission.Group != "" {
+					resource = permission.Resource + "." + permission.Group
+				}
+				denied = append(denied, fmt.Sprintf("cannot %s %s in namespace [%s]", verb, resource, zone))
+			}
+		}
 	}
 
+	if len(denied) > 0 {
+		return newPermissionDeniedError(denied)
+	}
 	return nil
 }
 
@@ -326,7 +428,8 @@ func (p *KubeHandler) ValidateRuntime(zone string, runtimeCredential *models.Run
 		return gerr.NewWithDetail(nil, gerr.InvalidArgument, err, gerr.ErrorCredentialIllegal, "kubeconfig")
 	}
 
-	err = p.checkTillerIsExistedAndRunning(client, runtimeCredential.RuntimeCredentialContent, zone)
+	storageDriver := GetRuntimeOptions(p.RuntimeId).GetReleaseStorage().Driver
+	err = p.checkPermissions(client.AuthorizationV1().SelfSubjectAccessReviews(), zone, getRuntimePermissions(storageDriver))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,332 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/status"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/models"
+	"openpitrix.io/openpitrix/pkg/pb"
+	"openpitrix.io/openpitrix/pkg/util/jsonutil"
+)
+
+// fakeAccessReviews allows every access except the denied resources
+type fakeAccessReviews struct {
+	denied map[string]bool
+}
+
+func (f *fakeAccessReviews) Create(sar *authorizationv1.SelfSubjectAccessReview) (*authorizationv1.SelfSubjectAccessReview, error) {
+	attributes := sar.Spec.ResourceAttributes
+	sar.Status.Allowed = !f.denied[attributes.Verb+" "+attributes.Resource]
+	return sar, nil
+}
+
+func TestCheckPermissions(t *testing.T) {
+	kubeHandler := GetKubeHandler(nil, "runtime-test")
+
+	err := kubeHandler.checkPermissions(&fakeAccessReviews{}, "test-zone", getRuntimePermissions(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reviews := &fakeAccessReviews{denied: map[string]bool{
+		"create secrets":     true,
+		"delete deployments": true,
+		"create configmaps":  true,
+	}}
+	err = kubeHandler.checkPermissions(reviews, "test-zone", getRuntimePermissions(ReleaseStorageSecrets))
+	if err == nil {
+		t.Fatalf("expected error for denied permissions")
+	}
+
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != gerr.PermissionDenied {
+		t.Fatalf("expected grpc error with code [%s], got [%+v]", gerr.PermissionDenied, err)
+	}
+	var causes []string
+	for _, detail := range s.Details()[1:] {
+		causes = append(causes, detail.(*pb.ErrorDetail).Cause)
+	}
+	expected := []string{
+		"cannot create secrets in namespace [test-zone]",
+		"cannot delete deployments.apps in namespace [test-zone]",
+	}
+	if len(causes) != len(expected) {
+		t.Fatalf("expected details %v, got %v", expected, causes)
+	}
+	for i := range expected {
+		if causes[i] != expected[i] {
+			t.Errorf("expected detail [%s], got [%s]", expected[i], causes[i])
+		}
+	}
+
+	// the memory driver keeps no release in the namespace
+	err = kubeHandler.checkPermissions(reviews, "test-zone", getRuntimePermissions(ReleaseStorageMemory))
+	s, _ = status.FromError(err)
+	if len(s.Details()) != 2 {
+		t.Errorf("expected only the workload permission to be denied, got [%+v]", err)
+	}
+}
+
+func TestStopAndStartReplicas(t *testing.T) {
+	var replicas int32 = 3
+	deployment := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &replicas}}
+
+	if !stopReplicas(&deployment.ObjectMeta, &deployment.Spec.Replicas) {
+		t.Fatalf("expected deployment to be stopped")
+	}
+	if *deployment.Spec.Replicas != 0 || deployment.Annotations[StoppedReplicasAnnotationKey] != "3" {
+		t.Errorf("unexpected stopped deployment [%+v]", deployment)
+	}
+	// stopping again keeps the recorded replicas
+	if stopReplicas(&deployment.ObjectMeta, &deployment.Spec.Replicas) {
+		t.Errorf("expected deployment already stopped")
+	}
+
+	started, err := startReplicas(&deployment.ObjectMeta, &deployment.Spec.Replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !started || *deployment.Spec.Replicas != 3 {
+		t.Errorf("expected [3] replicas restored, got [%d]", *deployment.Spec.Replicas)
+	}
+	if _, ok := deployment.Annotations[StoppedReplicasAnnotationKey]; ok {
+		t.Errorf("expected annotation [%s] removed", StoppedReplicasAnnotationKey)
+	}
+	started, err = startReplicas(&deployment.ObjectMeta, &deployment.Spec.Replicas)
+	if err != nil || started {
+		t.Errorf("expected deployment not stopped, got [%t] [%+v]", started, err)
+	}
+}
+
+func TestStopAndStartDaemonSet(t *testing.T) {
+	daemonSet := new(appsv1.DaemonSet)
+	daemonSet.Spec.Template.Spec.NodeSelector = map[string]string{"disk": "ssd"}
+
+	if !stopDaemonSet(daemonSet) {
+		t.Fatalf("expected daemonset to be stopped")
+	}
+	nodeSelector := daemonSet.Spec.Template.Spec.NodeSelector
+	if len(nodeSelector) != 1 || nodeSelector[StoppedNodeSelectorKey] != "true" {
+		t.Errorf("unexpected node selector of stopped daemonset [%+v]", nodeSelector)
+	}
+
+	started, err := startDaemonSet(daemonSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeSelector = daemonSet.Spec.Template.Spec.NodeSelector
+	if !started || len(nodeSelector) != 1 || nodeSelector["disk"] != "ssd" {
+		t.Errorf("expected node selector restored, got [%+v]", nodeSelector)
+	}
+	if _, ok := daemonSet.Annotations[StoppedNodeSelectorAnnotationKey]; ok {
+		t.Errorf("expected annotation [%s] removed", StoppedNodeSelectorAnnotationKey)
+	}
+}
+
+const testQuotaManifests = `apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: mysql
+spec:
+  replicas: 3
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox
+        resources:
+          requests:
+            cpu: 3
+            memory: 1Gi
+      containers:
+      - name: mysql
+        image: mysql
+        resources:
+          requests:
+            cpu: 1500m
+            memory: 4Gi
+          limits:
+            cpu: 2
+            memory: 4Gi
+      - name: metrics
+        image: mysqld-exporter
+        resources:
+          limits:
+            cpu: 500m
+            memory: 256Mi
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+    spec:
+      storageClassName: ssd
+      resources:
+        requests:
+          storage: 10Gi
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: exporter
+spec:
+  replicas: 2
+  template:
+    spec:
+      containers:
+      - name: exporter
+        image: exporter
+---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: backup
+spec:
+  resources:
+    requests:
+      storage: 5Gi
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: mysql
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: mysql-headless
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: mysql
+`
+
+// newTestQuotaCluster returns the cluster with the additional info parsed from the test manifests as the parser does
+func newTestQuotaCluster(t *testing.T) *models.ClusterWrapper {
+	additionalInfo := map[string][]map[string]interface{}{"configmap": {}}
+	for _, manifest := range strings.Split(testQuotaManifests, "---\n") {
+		obj, groupVersionKind, err := decodeManifest([]byte(manifest))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		workload, err := getWorkloadInfo(groupVersionKind.GroupKind(), obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if workload != nil {
+			additionalInfo["workload"] = append(additionalInfo["workload"], workload)
+		}
+
+		switch o := obj.(type) {
+		case *corev1.PersistentVolumeClaim:
+			additionalInfo["pvc"] = append(additionalInfo["pvc"], getVolumeClaimInfo(o))
+		case *corev1.Service:
+			additionalInfo["service"] = append(additionalInfo["service"], map[string]interface{}{"name": o.Name})
+		case *corev1.Secret:
+			additionalInfo["secret"] = append(additionalInfo["secret"], map[string]interface{}{"name": o.Name})
+		}
+	}
+
+	return &models.ClusterWrapper{
+		Cluster: &models.Cluster{AdditionalInfo: jsonutil.ToString(additionalInfo)},
+	}
+}
+
+func TestGetClusterResourceRequests(t *testing.T) {
+	limitRanges := []corev1.LimitRange{{
+		Spec: corev1.LimitRangeSpec{Limits: []corev1.LimitRangeItem{{
+			Type:           corev1.LimitTypeContainer,
+			Default:        corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1"), corev1.ResourceMemory: resource.MustParse("1Gi")},
+			DefaultRequest: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+		}}},
+	}}
+
+	requests, err := getClusterResourceRequests(newTestQuotaCluster(t), limitRanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[corev1.ResourceName]string{
+		// 3 * 3 cpu of the init container of mysql more than its containers, 2 * 500m cpu of exporter by default
+		corev1.ResourceRequestsCPU: "10",
+		corev1.ResourceCPU:         "10",
+		// 3 * (4Gi + 256Mi) of mysql requested by the limit of metrics, 2 * 1Gi of exporter by the default limit
+		corev1.ResourceRequestsMemory: "15104Mi",
+		corev1.ResourceLimitsCPU:      "9500m",
+		corev1.ResourceLimitsMemory:   "15104Mi",
+		// no ephemeral storage is requested
+		corev1.ResourceRequestsEphemeralStorage: "0",
+		// 3 * 10Gi of the volume claim templates of mysql and 5Gi of backup
+		corev1.ResourceRequestsStorage:                           "35Gi",
+		"ssd.storageclass.storage.k8s.io/requests.storage":       "30Gi",
+		corev1.ResourcePersistentVolumeClaims:                    "4",
+		"ssd.storageclass.storage.k8s.io/persistentvolumeclaims": "3",
+		corev1.ResourcePods:                                      "5",
+		"count/statefulsets.apps":                                "1",
+		"count/deployments.apps":                                 "1",
+		corev1.ResourceServices:                                  "2",
+		corev1.ResourceSecrets:                                   "1",
+		corev1.ResourceConfigMaps:                                "0",
+	} {
+		quantity := requests[name]
+		if quantity.Cmp(resource.MustParse(expected)) != 0 {
+			t.Errorf("expected [%s] of [%s] requested, got [%s]", expected, name, quantity.String())
+		}
+	}
+}
+
+func TestGetResourceShortfalls(t *testing.T) {
+	requests, err := getClusterResourceRequests(newTestQuotaCluster(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quotas := []corev1.ResourceQuota{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "compute"},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("8"), corev1.ResourceRequestsMemory: resource.MustParse("16Gi"), corev1.ResourcePods: resource.MustParse("10")},
+				Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("4"), corev1.ResourceRequestsMemory: resource.MustParse("2Gi"), corev1.ResourcePods: resource.MustParse("4")},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "objects"},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourceServices: resource.MustParse("2")},
+				Used: corev1.ResourceList{corev1.ResourceServices: resource.MustParse("1")},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "best-effort"},
+			Spec:       corev1.ResourceQuotaSpec{Scopes: []corev1.ResourceQuotaScope{corev1.ResourceQuotaScopeBestEffort}},
+			Status: corev1.ResourceQuotaStatus{
+				Hard: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("0")},
+			},
+		},
+	}
+
+	shortfalls := getResourceShortfalls(quotas, requests)
+	expected := []ResourceShortfall{
+		{Quota: "compute", Resource: "requests.cpu", Requested: "9", Available: "4", Shortfall: "5"},
+		{Quota: "objects", Resource: "services", Requested: "2", Available: "1", Shortfall: "1"},
+	}
+	if len(shortfalls) != len(expected) {
+		t.Fatalf("expected shortfalls [%+v], got [%+v]", expected, shortfalls)
+	}
+	for i := range expected {
+		if shortfalls[i] != expected[i] {
+			t.Errorf("expected shortfall [%+v], got [%+v]", expected[i], shortfalls[i])
+		}
+	}
+}
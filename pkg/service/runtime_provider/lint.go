@@ -0,0 +1,122 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"helm.sh/helm/pkg/action"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chartutil"
+	"helm.sh/helm/pkg/lint/support"
+	"sigs.k8s.io/yaml"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+)
+
+var lintSeverities = map[int]string{
+	support.UnknownSev: "unknown",
+	support.InfoSev:    "info",
+	support.WarningSev: "warning",
+	support.ErrorSev:   "error",
+}
+
+// the template the rendering failed in, e.g. "execution error at (mysql/templates/secret.yaml:3:12): ..."
+var lintTemplateRegex = regexp.MustCompile(`^(?:(?:parse|execution) error (?:at|in) \(|template: )([^():]+)`)
+
+// LintFinding is a finding of the lint, the path is the template the values failed to render, or the file of the chart
+type LintFinding struct {
+	Severity string
+	Path     string
+	Message  string
+}
+
+func (f LintFinding) String() string {
+	return fmt.Sprintf("%s: %s", f.Path, f.Message)
+}
+
+func newLintFinding(msg support.Message) LintFinding {
+	path := msg.Path
+	if m := lintTemplateRegex.FindStringSubmatch(msg.Err.Error()); len(m) > 1 {
+		path = m[1]
+	}
+	return LintFinding{
+		Severity: lintSeverities[msg.Severity],
+		Path:     path,
+		Message:  msg.Err.Error(),
+	}
+}
+
+// LintChart lints the chart with its subcharts the same way as "helm lint", the values are the custom values
+// merged into the chart values. The findings of error severity fail the lint, the others are returned
+func LintChart(c *chart.Chart, vals map[string]interface{}, namespace string) ([]LintFinding, error) {
+	dir, err := ioutil.TempDir("", "chart-lint")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// charts of apiVersion v1 declare the dependencies in requirements.yaml, which is not kept by the loader
+	if c.Metadata.APIVersion == chart.APIVersionV1 && len(c.Metadata.Dependencies) > 0 {
+		requirements, err := yaml.Marshal(map[string]interface{}{"dependencies": c.Metadata.Dependencies})
+		if err != nil {
+			return nil, err
+		}
+		metadata := *c.Metadata
+		metadata.Dependencies = nil
+
+		saved := *c
+		saved.Metadata = &metadata
+		saved.Files = append([]*chart.File{{Name: "requirements.yaml", Data: requirements}}, c.Files...)
+		c = &saved
+	}
+
+	// the lint runs on the files of the chart
+	err = chartutil.SaveDir(c, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lintClient := action.NewLint()
+	lintClient.Namespace = namespace
+	result := lintClient.Run([]string{filepath.Join(dir, c.Name())}, vals)
+
+	var findings []LintFinding
+	var errs []string
+	for _, msg := range result.Messages {
+		finding := newLintFinding(msg)
+		if msg.Severity == support.ErrorSev {
+			errs = append(errs, finding.String())
+		} else {
+			findings = append(findings, finding)
+		}
+	}
+	// the errors out of the messages fail the lint before any rule runs
+	if len(errs) == 0 {
+		for _, err := range result.Errors {
+			errs = append(errs, fmt.Sprintf("%s: %+v", c.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, newDetailedError(nil, gerr.InvalidArgument, gerr.ErrorValidateFailed, errs)
+	}
+	return findings, nil
+}
+
+func getLintInfo(findings []LintFinding) []map[string]interface{} {
+	info := []map[string]interface{}{}
+	for _, finding := range findings {
+		info = append(info, map[string]interface{}{
+			"severity": finding.Severity,
+			"path":     finding.Path,
+			"message":  finding.Message,
+		})
+	}
+	return info
+}
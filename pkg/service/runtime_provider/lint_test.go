@@ -0,0 +1,72 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/status"
+	"helm.sh/helm/pkg/chart"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/pb"
+)
+
+func TestLintChart(t *testing.T) {
+	c := newTestChart()
+	c.Templates = append(c.Templates, &chart.File{
+		Name: "templates/fail.yaml",
+		Data: []byte(`{{ if .Values.fail }}{{ fail "values failed" }}{{ end }}`),
+	})
+
+	findings, err := LintChart(c, nil, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := getLintInfo(findings)
+	var found bool
+	for _, finding := range info {
+		if finding["severity"] == "info" && finding["path"] == "Chart.yaml" && finding["message"] == "icon is recommended" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected info of missing icon in findings [%+v]", info)
+	}
+
+	// the custom values break the templates, the finding is reported in the template failed
+	_, err = LintChart(c, map[string]interface{}{"fail": true}, "default")
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != gerr.InvalidArgument {
+		t.Fatalf("expected grpc error with code [%s], got [%+v]", gerr.InvalidArgument, err)
+	}
+	// the first detail is the error of all the findings
+	var causes []string
+	for _, detail := range s.Details()[1:] {
+		if d, ok := detail.(*pb.ErrorDetail); ok && d.Cause != "" {
+			causes = append(causes, d.Cause)
+		}
+	}
+	if len(causes) != 1 || !strings.HasPrefix(causes[0], "test/templates/fail.yaml: ") || !strings.Contains(causes[0], "values failed") {
+		t.Errorf("expected lint error of the values in template [test/templates/fail.yaml], got [%+v]", causes)
+	}
+
+	c = newTestChart()
+	c.Templates[0].Data = []byte(`{{ .Values.image.tag | nosuchfunc }}`)
+	_, err = LintChart(c, nil, "default")
+	if err == nil {
+		t.Errorf("expected lint error of the templates")
+	}
+
+	// the dependencies of charts of apiVersion v1 come from requirements.yaml
+	c = newTestChart()
+	c.Metadata.Dependencies = []*chart.Dependency{{Name: "redis", Version: "0.1.0"}}
+	c.AddDependency(newTestSubchart("redis", "0.1.0"))
+	_, err = LintChart(c, nil, "default")
+	if err != nil {
+		t.Errorf("expected chart of apiVersion v1 with dependencies linted, got [%+v]", err)
+	}
+}
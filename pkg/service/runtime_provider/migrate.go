@@ -0,0 +1,362 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chartutil"
+	"helm.sh/helm/pkg/release"
+	"helm.sh/helm/pkg/storage"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	hapichart "k8s.io/helm/pkg/proto/hapi/chart"
+	hapirelease "k8s.io/helm/pkg/proto/hapi/release"
+	helm2driver "k8s.io/helm/pkg/storage/driver"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	TillerStorageConfigMaps = "configmaps"
+	TillerStorageSecrets    = "secrets"
+)
+
+const (
+	MigrationResultMigrated = "migrated"
+	MigrationResultExists   = "exists"
+	MigrationResultDryRun   = "to migrate"
+	MigrationResultFailed   = "failed"
+)
+
+var helm2ReleaseStatus = map[hapirelease.Status_Code]release.Status{
+	hapirelease.Status_UNKNOWN:          release.StatusUnknown,
+	hapirelease.Status_DEPLOYED:         release.StatusDeployed,
+	hapirelease.Status_DELETED:          release.StatusUninstalled,
+	hapirelease.Status_SUPERSEDED:       release.StatusSuperseded,
+	hapirelease.Status_FAILED:           release.StatusFailed,
+	hapirelease.Status_DELETING:         release.StatusUninstalling,
+	hapirelease.Status_PENDING_INSTALL:  release.StatusPendingInstall,
+	hapirelease.Status_PENDING_UPGRADE:  release.StatusPendingUpgrade,
+	hapirelease.Status_PENDING_ROLLBACK: release.StatusPendingRollback,
+}
+
+var helm2HookEvents = map[hapirelease.Hook_Event]release.HookEvent{
+	hapirelease.Hook_PRE_INSTALL:          release.HookPreInstall,
+	hapirelease.Hook_POST_INSTALL:         release.HookPostInstall,
+	hapirelease.Hook_PRE_DELETE:           release.HookPreDelete,
+	hapirelease.Hook_POST_DELETE:          release.HookPostDelete,
+	hapirelease.Hook_PRE_UPGRADE:          release.HookPreUpgrade,
+	hapirelease.Hook_POST_UPGRADE:         release.HookPostUpgrade,
+	hapirelease.Hook_PRE_ROLLBACK:         release.HookPreRollback,
+	hapirelease.Hook_POST_ROLLBACK:        release.HookPostRollback,
+	hapirelease.Hook_RELEASE_TEST_SUCCESS: release.HookTest,
+	hapirelease.Hook_RELEASE_TEST_FAILURE: release.HookTest,
+}
+
+var helm2HookDeletePolicies = map[hapirelease.Hook_DeletePolicy]release.HookDeletePolicy{
+	hapirelease.Hook_SUCCEEDED:            release.HookSucceeded,
+	hapirelease.Hook_FAILED:               release.HookFailed,
+	hapirelease.Hook_BEFORE_HOOK_CREATION: release.HookBeforeHookCreation,
+}
+
+// MigrationResult is the outcome of migrating a revision of a helm2 release
+type MigrationResult struct {
+	Name    string
+	Version int
+	Status  string
+	Result  string
+	Error   string
+	Cleaned bool
+}
+
+// Helm2Migrator converts the helm2 releases of a namespace kept by Tiller into helm3 releases
+type Helm2Migrator struct {
+	// Tiller is the storage of Tiller, configmaps or secrets in its namespace
+	Tiller helm2driver.Driver
+	// Releases is the helm3 storage of the runtime namespace
+	Releases  *storage.Storage
+	Namespace string
+	DryRun    bool
+	// Cleanup deletes the Tiller records of the releases with all revisions migrated
+	Cleanup bool
+	Log     func(string, ...interface{})
+}
+
+func NewHelm2Migrator(tiller helm2driver.Driver, releases *storage.Storage, namespace string) *Helm2Migrator {
+	return &Helm2Migrator{
+		Tiller:    tiller,
+		Releases:  releases,
+		Namespace: namespace,
+		Log:       func(_ string, _ ...interface{}) {},
+	}
+}
+
+// NewTillerStorage returns the storage of the Tiller in tillerNamespace of the cluster in credentialContent
+func NewTillerStorage(credentialContent []byte, tillerNamespace, tillerStorage string) (helm2driver.Driver, error) {
+	config, err := clientcmd.RESTConfigFromKubeConfig(credentialContent)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	switch tillerStorage {
+	case TillerStorageConfigMaps, "":
+		return helm2driver.NewConfigMaps(clientset.CoreV1().ConfigMaps(tillerNamespace)), nil
+	case TillerStorageSecrets:
+		return helm2driver.NewSecrets(clientset.CoreV1().Secrets(tillerNamespace)), nil
+	default:
+		return nil, fmt.Errorf("tiller storage [%s] is not supported", tillerStorage)
+	}
+}
+
+// Run migrates the releases in releaseNames, all releases of the namespace when releaseNames is empty
+func (m *Helm2Migrator) Run(releaseNames []string) ([]*MigrationResult, error) {
+	names := make(map[string]bool)
+	for _, name := range releaseNames {
+		names[name] = true
+	}
+
+	rlss, err := m.Tiller.List(func(r *hapirelease.Release) bool {
+		return r.Namespace == m.Namespace && (len(names) == 0 || names[r.Name])
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rlss, func(i, j int) bool {
+		if rlss[i].Name != rlss[j].Name {
+			return rlss[i].Name < rlss[j].Name
+		}
+		return rlss[i].Version < rlss[j].Version
+	})
+
+	var results []*MigrationResult
+	for len(rlss) > 0 {
+		n := 1
+		for n < len(rlss) && rlss[n].Name == rlss[0].Name {
+			n++
+		}
+		results = append(results, m.migrateRelease(rlss[:n])...)
+		rlss = rlss[n:]
+	}
+	return results, nil
+}
+
+// migrateRelease migrates the revisions of a release, and cleans them up when all of them are migrated
+func (m *Helm2Migrator) migrateRelease(revisions []*hapirelease.Release) []*MigrationResult {
+	var results []*MigrationResult
+	migrated := true
+	for _, r := range revisions {
+		result := &MigrationResult{
+			Name:    r.Name,
+			Version: int(r.Version),
+			Status:  r.GetInfo().GetStatus().GetCode().String(),
+		}
+		results = append(results, result)
+
+		err := m.migrateRevision(r, result)
+		if err != nil {
+			m.Log("migrate release [%s] revision [%d] failed: %+v", r.Name, r.Version, err)
+			result.Result = MigrationResultFailed
+			result.Error = err.Error()
+			migrated = false
+		}
+	}
+
+	if !migrated || !m.Cleanup || m.DryRun {
+		return results
+	}
+
+	for _, result := range results {
+		_, err := m.Tiller.Delete(fmt.Sprintf("%s.v%d", result.Name, result.Version))
+		if err != nil {
+			m.Log("clean up release [%s] revision [%d] failed: %+v", result.Name, result.Version, err)
+			result.Error = err.Error()
+			continue
+		}
+		result.Cleaned = true
+	}
+	return results
+}
+
+func (m *Helm2Migrator) migrateRevision(r *hapirelease.Release, result *MigrationResult) error {
+	_, err := m.Releases.Get(r.Name, int(r.Version))
+	if err == nil {
+		result.Result = MigrationResultExists
+		return nil
+	}
+
+	rls, err := ConvertHelm2Release(r)
+	if err != nil {
+		return err
+	}
+
+	if m.DryRun {
+		result.Result = MigrationResultDryRun
+		return nil
+	}
+
+	err = m.Releases.Create(rls)
+	if err != nil {
+		return err
+	}
+	result.Result = MigrationResultMigrated
+	return nil
+}
+
+func convertTimestamp(ts *tspb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// ConvertHelm2Release converts a helm2 release kept by Tiller into a helm3 release
+func ConvertHelm2Release(r *hapirelease.Release) (*release.Release, error) {
+	c, err := convertHelm2Chart(r.Chart)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := chartutil.ReadValues([]byte(r.GetConfig().GetRaw()))
+	if err != nil {
+		return nil, err
+	}
+
+	info := r.GetInfo()
+	status, ok := helm2ReleaseStatus[info.GetStatus().GetCode()]
+	if !ok {
+		status = release.StatusUnknown
+	}
+
+	var hooks []*release.Hook
+	for _, h := range r.Hooks {
+		hook := &release.Hook{
+			Name:     h.Name,
+			Kind:     h.Kind,
+			Path:     h.Path,
+			Manifest: h.Manifest,
+			Weight:   int(h.Weight),
+			LastRun: release.HookExecution{
+				StartedAt:   convertTimestamp(h.LastRun),
+				CompletedAt: convertTimestamp(h.LastRun),
+			},
+		}
+		for _, e := range h.Events {
+			if event, ok := helm2HookEvents[e]; ok {
+				hook.Events = append(hook.Events, event)
+			}
+		}
+		for _, p := range h.DeletePolicies {
+			if policy, ok := helm2HookDeletePolicies[p]; ok {
+				hook.DeletePolicies = append(hook.DeletePolicies, policy)
+			}
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return &release.Release{
+		Name: r.Name,
+		Info: &release.Info{
+			FirstDeployed: convertTimestamp(info.GetFirstDeployed()),
+			LastDeployed:  convertTimestamp(info.GetLastDeployed()),
+			Deleted:       convertTimestamp(info.GetDeleted()),
+			Description:   info.GetDescription(),
+			Status:        status,
+			Notes:         info.GetStatus().GetNotes(),
+		},
+		Chart:     c,
+		Config:    config,
+		Manifest:  r.Manifest,
+		Hooks:     hooks,
+		Version:   int(r.Version),
+		Namespace: r.Namespace,
+	}, nil
+}
+
+func convertHelm2Chart(hc *hapichart.Chart) (*chart.Chart, error) {
+	if hc == nil {
+		return nil, nil
+	}
+
+	md := hc.GetMetadata()
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:        md.GetName(),
+			Home:        md.GetHome(),
+			Sources:     md.GetSources(),
+			Version:     md.GetVersion(),
+			Description: md.GetDescription(),
+			Keywords:    md.GetKeywords(),
+			Icon:        md.GetIcon(),
+			APIVersion:  md.GetApiVersion(),
+			Condition:   md.GetCondition(),
+			Tags:        md.GetTags(),
+			AppVersion:  md.GetAppVersion(),
+			Deprecated:  md.GetDeprecated(),
+			Annotations: md.GetAnnotations(),
+			KubeVersion: md.GetKubeVersion(),
+		},
+	}
+	if c.Metadata.APIVersion == "" {
+		c.Metadata.APIVersion = chart.APIVersionV1
+	}
+	for _, m := range md.GetMaintainers() {
+		c.Metadata.Maintainers = append(c.Metadata.Maintainers, &chart.Maintainer{
+			Name:  m.GetName(),
+			Email: m.GetEmail(),
+			URL:   m.GetUrl(),
+		})
+	}
+
+	for _, t := range hc.Templates {
+		c.Templates = append(c.Templates, &chart.File{Name: t.Name, Data: t.Data})
+	}
+
+	values, err := chartutil.ReadValues([]byte(hc.GetValues().GetRaw()))
+	if err != nil {
+		return nil, err
+	}
+	c.Values = values
+
+	for _, f := range hc.Files {
+		switch f.TypeUrl {
+		// the dependencies of helm2 charts are in Chart.yaml of helm3 charts
+		case "requirements.yaml":
+			err = yaml.Unmarshal(f.Value, c.Metadata)
+			if err != nil {
+				return nil, err
+			}
+		case "requirements.lock":
+			c.Lock = new(chart.Lock)
+			err = yaml.Unmarshal(f.Value, c.Lock)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			c.Files = append(c.Files, &chart.File{Name: f.TypeUrl, Data: f.Value})
+		}
+	}
+
+	for _, d := range hc.Dependencies {
+		dependency, err := convertHelm2Chart(d)
+		if err != nil {
+			return nil, err
+		}
+		c.AddDependency(dependency)
+	}
+	return c, nil
+}
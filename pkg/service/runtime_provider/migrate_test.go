@@ -0,0 +1,186 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"helm.sh/helm/pkg/release"
+	"helm.sh/helm/pkg/storage"
+	"helm.sh/helm/pkg/storage/driver"
+	hapichart "k8s.io/helm/pkg/proto/hapi/chart"
+	hapirelease "k8s.io/helm/pkg/proto/hapi/release"
+	helm2driver "k8s.io/helm/pkg/storage/driver"
+)
+
+func newTestHelm2Release(name, namespace string, version int32, code hapirelease.Status_Code) *hapirelease.Release {
+	deployed, _ := ptypes.TimestampProto(time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC))
+	return &hapirelease.Release{
+		Name:      name,
+		Namespace: namespace,
+		Version:   version,
+		Info: &hapirelease.Info{
+			Status:        &hapirelease.Status{Code: code, Notes: "test notes"},
+			FirstDeployed: deployed,
+			LastDeployed:  deployed,
+			Description:   "Install complete",
+		},
+		Chart: &hapichart.Chart{
+			Metadata: &hapichart.Metadata{
+				Name:        "test",
+				Version:     "0.1.0",
+				Maintainers: []*hapichart.Maintainer{{Name: "op", Url: "https://openpitrix.io"}},
+			},
+			Templates: []*hapichart.Template{
+				{Name: "templates/configmap.yaml", Data: []byte(testConfigMapTemplate)},
+			},
+			Values: &hapichart.Config{Raw: "image:\n  repository: nginx\n"},
+			Files: []*any.Any{
+				{TypeUrl: "requirements.yaml", Value: []byte("dependencies:\n- name: redis\n  version: 1.0.0\n")},
+				{TypeUrl: "README.md", Value: []byte("test")},
+			},
+			Dependencies: []*hapichart.Chart{
+				{Metadata: &hapichart.Metadata{Name: "redis", Version: "1.0.0"}},
+			},
+		},
+		Config:   &hapichart.Config{Raw: "image:\n  tag: \"1.17\"\n"},
+		Manifest: "test manifest",
+		Hooks: []*hapirelease.Hook{{
+			Name:           "test-hook",
+			Kind:           "Pod",
+			Events:         []hapirelease.Hook_Event{hapirelease.Hook_RELEASE_TEST_SUCCESS},
+			DeletePolicies: []hapirelease.Hook_DeletePolicy{hapirelease.Hook_BEFORE_HOOK_CREATION},
+		}},
+	}
+}
+
+func newTestTiller(t *testing.T) helm2driver.Driver {
+	tiller := helm2driver.NewMemory()
+	for _, r := range []*hapirelease.Release{
+		newTestHelm2Release("test", "test-zone", 1, hapirelease.Status_SUPERSEDED),
+		newTestHelm2Release("test", "test-zone", 2, hapirelease.Status_DEPLOYED),
+		newTestHelm2Release("other", "other-zone", 1, hapirelease.Status_DEPLOYED),
+	} {
+		err := tiller.Create(fmt.Sprintf("%s.v%d", r.Name, r.Version), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tiller
+}
+
+func TestConvertHelm2Release(t *testing.T) {
+	rls, err := ConvertHelm2Release(newTestHelm2Release("test", "test-zone", 2, hapirelease.Status_DEPLOYED))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rls.Name != "test" || rls.Namespace != "test-zone" || rls.Version != 2 {
+		t.Errorf("unexpected release [%+v]", rls)
+	}
+	if rls.Info.Status != release.StatusDeployed || rls.Info.Notes != "test notes" {
+		t.Errorf("unexpected release info [%+v]", rls.Info)
+	}
+	if rls.Info.LastDeployed.Year() != 2019 {
+		t.Errorf("expected last deployed in [2019], got [%s]", rls.Info.LastDeployed)
+	}
+	if rls.Config["image"].(map[string]interface{})["tag"] != "1.17" {
+		t.Errorf("unexpected config [%+v]", rls.Config)
+	}
+
+	c := rls.Chart
+	if err = c.Validate(); err != nil {
+		t.Errorf("expected valid chart, got [%+v]", err)
+	}
+	if c.Metadata.Maintainers[0].URL != "https://openpitrix.io" {
+		t.Errorf("unexpected maintainers [%+v]", c.Metadata.Maintainers[0])
+	}
+	if len(c.Metadata.Dependencies) != 1 || c.Metadata.Dependencies[0].Name != "redis" {
+		t.Errorf("expected dependency [redis] from requirements.yaml, got [%+v]", c.Metadata.Dependencies)
+	}
+	if len(c.Dependencies()) != 1 || c.Dependencies()[0].Parent() != c {
+		t.Errorf("expected subchart [redis], got [%+v]", c.Dependencies())
+	}
+	if len(c.Files) != 1 || c.Files[0].Name != "README.md" {
+		t.Errorf("unexpected files [%+v]", c.Files)
+	}
+	if c.Values["image"].(map[string]interface{})["repository"] != "nginx" {
+		t.Errorf("unexpected values [%+v]", c.Values)
+	}
+
+	hook := rls.Hooks[0]
+	if len(hook.Events) != 1 || hook.Events[0] != release.HookTest {
+		t.Errorf("expected test hook, got [%+v]", hook.Events)
+	}
+	if len(hook.DeletePolicies) != 1 || hook.DeletePolicies[0] != release.HookBeforeHookCreation {
+		t.Errorf("unexpected hook delete policies [%+v]", hook.DeletePolicies)
+	}
+}
+
+func TestHelm2Migrator(t *testing.T) {
+	tiller := newTestTiller(t)
+	releases := storage.Init(driver.NewMemory())
+
+	migrator := NewHelm2Migrator(tiller, releases, "test-zone")
+	migrator.DryRun = true
+	migrator.Cleanup = true
+	results, err := migrator.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected [2] revisions of the namespace, got [%d]", len(results))
+	}
+	for _, result := range results {
+		if result.Result != MigrationResultDryRun || result.Cleaned {
+			t.Errorf("unexpected dry run result [%+v]", result)
+		}
+	}
+	if _, err = releases.History("test"); err == nil {
+		t.Errorf("expected no release migrated in dry run")
+	}
+
+	migrator.DryRun = false
+	migrator.Cleanup = false
+	results, err = migrator.Run([]string{"test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Version != i+1 || result.Result != MigrationResultMigrated {
+			t.Errorf("unexpected result [%+v]", result)
+		}
+	}
+	rls, err := releases.Deployed("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rls.Version != 2 {
+		t.Errorf("expected deployed revision [2], got [%d]", rls.Version)
+	}
+
+	// migrated revisions are kept, and cleaned up from tiller
+	migrator.Cleanup = true
+	results, err = migrator.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Result != MigrationResultExists || !result.Cleaned {
+			t.Errorf("unexpected result [%+v]", result)
+		}
+	}
+	rlss, err := tiller.List(func(*hapirelease.Release) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rlss) != 1 || rlss[0].Name != "other" {
+		t.Errorf("expected only release [other] left in tiller, got [%d] releases", len(rlss))
+	}
+}
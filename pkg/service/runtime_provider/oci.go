@@ -0,0 +1,184 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	orascontent "github.com/deislabs/oras/pkg/content"
+	"github.com/deislabs/oras/pkg/oras"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chart/loader"
+	"helm.sh/helm/pkg/chartutil"
+
+	"openpitrix.io/openpitrix/pkg/logger"
+)
+
+const (
+	// OCIScheme prefixes the reference of a chart in an OCI registry, e.g. "oci://harbor.example.com/library/mysql:0.1.0"
+	OCIScheme = "oci://"
+	// ChartReferenceKey is the key in Conf of the OCI reference of the chart installed instead of the app version package,
+	// which is allowed only when it is under one of the chart_references of the runtime
+	ChartReferenceKey = "Chart"
+
+	// the media types of helm charts in OCI registries, the same as helm client
+	HelmChartConfigMediaType       = "application/vnd.cncf.helm.config.v1+json"
+	HelmChartContentLayerMediaType = "application/vnd.cncf.helm.chart.content.layer.v1+tar"
+)
+
+func IsOCIReference(ref string) bool {
+	return strings.HasPrefix(ref, OCIScheme)
+}
+
+// getChartReference returns the OCI reference of the chart set in Conf
+func getChartReference(rawVals []byte) (string, bool) {
+	vals, err := chartutil.ReadValues(rawVals)
+	if err != nil {
+		return "", false
+	}
+	ref, ok := GetStringFromValues(vals, ChartReferenceKey)
+	if !ok || !IsOCIReference(ref) {
+		return "", false
+	}
+	return ref, true
+}
+
+// isChartReferenceAllowed reports whether the OCI reference in Conf is under one of the allowed references,
+// which match the registry host exactly and the repository path on a "/" boundary
+func isChartReferenceAllowed(allowed []string, ref string) bool {
+	if !IsOCIReference(ref) {
+		return false
+	}
+	spec, err := reference.Parse(strings.TrimPrefix(ref, OCIScheme))
+	if err != nil {
+		return false
+	}
+	host := spec.Hostname()
+	path := strings.TrimPrefix(spec.Locator, host+"/")
+
+	for _, prefix := range allowed {
+		prefix = strings.TrimSuffix(strings.TrimPrefix(prefix, OCIScheme), "/")
+		if prefix == "" {
+			continue
+		}
+		allowedHost, allowedPath := prefix, ""
+		if i := strings.Index(prefix, "/"); i >= 0 {
+			allowedHost, allowedPath = prefix[:i], prefix[i+1:]
+		}
+		if host != allowedHost {
+			continue
+		}
+		if allowedPath == "" || path == allowedPath || strings.HasPrefix(path, allowedPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// OCIPuller pulls charts from OCI registries with the registry credentials of a runtime
+type OCIPuller struct {
+	ctx        context.Context
+	Registries []*RegistryOptions
+	Cache      *ChartPackageCache
+}
+
+func NewOCIPuller(ctx context.Context, runtimeId string) *OCIPuller {
+	return &OCIPuller{
+		ctx:        ctx,
+		Registries: GetRuntimeOptions(runtimeId).Registries,
+		Cache:      dependencyCache,
+	}
+}
+
+func findRegistry(registries []*RegistryOptions, host string) *RegistryOptions {
+	for _, registry := range registries {
+		if registry.Host == host {
+			return registry
+		}
+	}
+	return nil
+}
+
+// newRegistryResolver returns the resolver of OCI registries and image registries with the registry credentials
+func newRegistryResolver(registries []*RegistryOptions) remotes.Resolver {
+	credentials := func(host string) (string, string, error) {
+		if registry := findRegistry(registries, host); registry != nil {
+			return registry.Username, registry.Password, nil
+		}
+		return "", "", nil
+	}
+	plainHttp := func(host string) (bool, error) {
+		if registry := findRegistry(registries, host); registry != nil && registry.PlainHttp {
+			return true, nil
+		}
+		return docker.MatchLocalhost(host)
+	}
+
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(
+			docker.WithAuthorizer(docker.NewDockerAuthorizer(docker.WithAuthCreds(credentials))),
+			docker.WithPlainHTTP(plainHttp),
+		),
+	})
+}
+
+// Pull pulls the chart at the OCI reference, pinned by a tag or a digest
+func (p *OCIPuller) Pull(ref string) (*chart.Chart, error) {
+	pkg, err := p.PullPackage(ref)
+	if err != nil {
+		return nil, err
+	}
+	return loader.LoadArchive(bytes.NewReader(pkg))
+}
+
+// PullPackage pulls the package of the chart at the OCI reference, the packages are cached by the digest
+// of their manifests, so a tag is resolved every time but its chart downloaded once
+func (p *OCIPuller) PullPackage(ref string) ([]byte, error) {
+	spec, err := reference.Parse(strings.TrimPrefix(ref, OCIScheme))
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart reference [%s]: %+v", ref, err)
+	}
+	if spec.Object == "" {
+		return nil, fmt.Errorf("chart reference [%s] has no tag or digest", ref)
+	}
+
+	resolver := newRegistryResolver(p.Registries)
+	_, manifest, err := resolver.Resolve(p.ctx, spec.String())
+	if err != nil {
+		return nil, err
+	}
+
+	key := OCIScheme + manifest.Digest.String()
+	pkg, ok := p.Cache.Get(key)
+	if !ok {
+		// pull by the digest resolved, in case the tag is moved meanwhile
+		store := orascontent.NewMemoryStore()
+		_, layers, err := oras.Pull(p.ctx, resolver, spec.Locator+"@"+manifest.Digest.String(), store,
+			oras.WithPullEmptyNameAllowed(),
+			oras.WithAllowedMediaTypes([]string{HelmChartConfigMediaType, HelmChartContentLayerMediaType}))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, layer := range layers {
+			if layer.MediaType == HelmChartContentLayerMediaType {
+				_, pkg, _ = store.Get(layer)
+				break
+			}
+		}
+		if len(pkg) == 0 {
+			return nil, fmt.Errorf("chart reference [%s] has no layer of media type [%s]", ref, HelmChartContentLayerMediaType)
+		}
+		logger.Debug(p.ctx, "Pulled chart [%s] with digest [%s]", ref, manifest.Digest)
+		p.Cache.Set(key, pkg)
+	}
+	return pkg, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chartutil"
+)
+
+const (
+	testRegistryUsername = "robot"
+	testRegistryPassword = "password"
+)
+
+// testRegistry stands in for an OCI registry serving the charts pushed to it, with basic auth
+type testRegistry struct {
+	manifests map[string][]byte
+	blobs     map[digest.Digest][]byte
+	pulls     map[digest.Digest]int
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[digest.Digest][]byte),
+		pulls:     make(map[digest.Digest]int),
+	}
+}
+
+func (r *testRegistry) addBlob(mediaType string, data []byte) ocispec.Descriptor {
+	d := digest.FromBytes(data)
+	r.blobs[d] = data
+	return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(data))}
+}
+
+// push adds the package of the chart at repo:tag, and returns the digest of its manifest and its content layer
+func (r *testRegistry) push(t *testing.T, repo, tag string, pkg []byte) (digest.Digest, digest.Digest) {
+	config := r.addBlob(HelmChartConfigMediaType, []byte(`{"name":"test"}`))
+	layer := r.addBlob(HelmChartContentLayerMediaType, pkg)
+
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := digest.FromBytes(manifest)
+	r.manifests[repo+":"+tag] = manifest
+	r.manifests[repo+":"+d.String()] = manifest
+	return d, layer.Digest
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	username, password, ok := req.BasicAuth()
+	if !ok || username != testRegistryUsername || password != testRegistryPassword {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	var data []byte
+	if i := strings.Index(path, "/manifests/"); i >= 0 {
+		data, ok = r.manifests[path[:i]+":"+path[i+len("/manifests/"):]]
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+	} else if i := strings.Index(path, "/blobs/"); i >= 0 {
+		d := digest.Digest(path[i+len("/blobs/"):])
+		data, ok = r.blobs[d]
+		if ok && req.Method == http.MethodGet {
+			r.pulls[d]++
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	if data == nil || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func newTestChartPackage(t *testing.T, c *chart.Chart) []byte {
+	dir, err := ioutil.TempDir("", "chart-package")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := chartutil.Save(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func TestOCIPuller(t *testing.T) {
+	registry := newTestRegistry()
+	manifestDigest, layerDigest := registry.push(t, "library/test", "0.1.0", newTestChartPackage(t, newTestChart()))
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	puller := &OCIPuller{
+		ctx:        context.Background(),
+		Registries: []*RegistryOptions{{Host: host, Username: testRegistryUsername, Password: testRegistryPassword}},
+		Cache:      NewChartPackageCache(),
+	}
+
+	for _, ref := range []string{
+		OCIScheme + host + "/library/test:0.1.0",
+		OCIScheme + host + "/library/test:0.1.0",
+		OCIScheme + host + "/library/test@" + manifestDigest.String(),
+	} {
+		c, err := puller.Pull(ref)
+		if err != nil {
+			t.Fatalf("pull chart [%s] failed: %+v", ref, err)
+		}
+		if c.Name() != "test" {
+			t.Errorf("expected chart [test] pulled from [%s], got [%s]", ref, c.Name())
+		}
+	}
+	if registry.pulls[layerDigest] != 1 {
+		t.Errorf("expected chart pulled once and then read from the cache by digest, pulled [%d] times", registry.pulls[layerDigest])
+	}
+
+	for _, ref := range []string{
+		OCIScheme + host + "/library/test",
+		OCIScheme + host + "/library/test:0.2.0",
+	} {
+		_, err := puller.Pull(ref)
+		if err == nil {
+			t.Errorf("expected error for chart [%s]", ref)
+		}
+	}
+
+	// the credentials are per runtime, another runtime has no access
+	puller = &OCIPuller{ctx: context.Background(), Cache: NewChartPackageCache()}
+	_, err := puller.Pull(OCIScheme + host + "/library/test:0.1.0")
+	if err == nil {
+		t.Errorf("expected error for pulling chart without credentials")
+	}
+}
+
+func TestGetChartReference(t *testing.T) {
+	ref, ok := getChartReference([]byte("Name: test\nChart: oci://harbor.example.com/library/test:0.1.0\n"))
+	if !ok || ref != "oci://harbor.example.com/library/test:0.1.0" {
+		t.Errorf("expected chart reference in conf, got [%s]", ref)
+	}
+
+	_, ok = getChartReference([]byte("Name: test\nChart: mysql\n"))
+	if ok {
+		t.Errorf("expected no chart reference for conf not referring to OCI registry")
+	}
+}
+
+func TestIsChartReferenceAllowed(t *testing.T) {
+	allowed := []string{"oci://harbor.example.com/library/"}
+
+	if !isChartReferenceAllowed(allowed, "oci://harbor.example.com/library/test:0.1.0") {
+		t.Errorf("expected chart reference under allowed prefix to be allowed")
+	}
+	// the allowed references match on the host and on a path boundary, with or without a trailing "/"
+	for _, prefix := range []string{"oci://harbor.example.com/library", "oci://harbor.example.com"} {
+		if !isChartReferenceAllowed([]string{prefix}, "oci://harbor.example.com/library/test:0.1.0") {
+			t.Errorf("expected chart reference under allowed reference [%s] to be allowed", prefix)
+		}
+	}
+	for _, ref := range []string{
+		"oci://harbor.example.com/other/test:0.1.0",
+		"oci://evil.example.com/library/test:0.1.0",
+		"oci://harbor.example.com/library-evil/test:0.1.0",
+		"oci://harbor.example.com.evil.com/library/test:0.1.0",
+		"oci://harbor.example.com:8443/library/test:0.1.0",
+	} {
+		if isChartReferenceAllowed(allowed, ref) {
+			t.Errorf("expected chart reference [%s] to be denied", ref)
+		}
+	}
+	if isChartReferenceAllowed(nil, "oci://harbor.example.com/library/test:0.1.0") {
+		t.Errorf("expected chart reference to be denied when the runtime allows none")
+	}
+}
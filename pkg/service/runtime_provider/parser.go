@@ -13,18 +13,17 @@ import (
 	"strings"
 	"time"
 
-	"github.com/ghodss/yaml"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chartutil"
+	"helm.sh/helm/pkg/engine"
+	"helm.sh/helm/pkg/releaseutil"
 	appsv1 "k8s.io/api/apps/v1"
 	appsv1beta1 "k8s.io/api/apps/v1beta1"
 	appsv1beta2 "k8s.io/api/apps/v1beta2"
 	corev1 "k8s.io/api/core/v1"
 	exv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
-	"k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/helm/pkg/chartutil"
-	"k8s.io/helm/pkg/engine"
-	"k8s.io/helm/pkg/proto/hapi/chart"
-	"k8s.io/helm/pkg/releaseutil"
 	_ "k8s.io/kubernetes/pkg/apis/apps/install"
 	_ "k8s.io/kubernetes/pkg/apis/extensions/install"
 
@@ -41,6 +40,11 @@ type Parser struct {
 	VersionId string
 	RuntimeId string
 	Namespace string
+	// Provenance is the verified signer and digest of the chart, nil when the runtime does not require signed charts
+	Provenance *ChartProvenance
+
+	lintFindings []LintFinding
+	skipCRDs     bool
 }
 
 func (p *Parser) parseCluster(name string, description string, additionalInfo string, customVals map[string]interface{}, appId string) (*models.Cluster, error) {
@@ -63,7 +67,7 @@ func (p *Parser) parseCluster(name string, description string, additionalInfo st
 	return cluster, nil
 }
 
-func (p *Parser) parseClusterRolesAndClusterCommons(vals map[string]interface{}) (
+func (p *Parser) parseClusterRolesAndClusterCommons(vals chartutil.Values) (
 	map[string]*models.ClusterRole,
 	map[string]*models.ClusterCommon,
 	string,
@@ -75,10 +79,14 @@ func (p *Parser) parseClusterRolesAndClusterCommons(vals map[string]interface{})
 		"secret":    {},
 		"pvc":       {},
 		"ingress":   {},
+		// the resources requested by the pods of the workloads, counted by the resource quotas
+		"workload": {},
+		// the custom resource definitions and the custom resources of kinds unknown to the parser
+		"crd":             {},
+		"custom_resource": {},
 	}
 
-	renderer := engine.New()
-	files, err := renderer.Render(p.Chart, vals)
+	files, err := engine.Render(p.Chart, vals)
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -87,8 +95,51 @@ func (p *Parser) parseClusterRolesAndClusterCommons(vals map[string]interface{})
 		return nil, nil, "", fmt.Errorf("this chart has no resources defined")
 	}
 
+	// the roles are parsed from the manifests patched by the kustomization of the runtime, as they are deployed
+	postRenderer := NewKustomizePostRenderer(p.RuntimeId)
+	if postRenderer != nil {
+		files, err = postRenderer.RenderFiles(files)
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+	var imageRewrites []ImageRewrite
+	imageRewriter := NewImageRewriter(p.ctx, p.RuntimeId)
+	if imageRewriter != nil {
+		// the digests are pinned once by the install or the upgrade and kept in the release, as they move meanwhile
+		files, imageRewrites, err = imageRewriter.withoutDigests().RewriteFiles(files)
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+
 	var apiVersions []string
-	decode := scheme.Codecs.UniversalDeserializer().Decode
+	// the api versions served by the custom resource definitions of the chart, which are not on the runtime before install
+	crdApiVersions := map[string]bool{}
+	appendCRD := func(crd *unstructured.Unstructured) {
+		additionalInfo["crd"] = append(additionalInfo["crd"], map[string]interface{}{
+			"apiVersion": crd.GetAPIVersion(),
+			"name":       crd.GetName(),
+		})
+		for _, apiVersion := range getCRDApiVersions(crd) {
+			crdApiVersions[apiVersion] = true
+		}
+	}
+
+	if !p.skipCRDs {
+		crds, err := getChartCRDs(p.Chart)
+		if err != nil {
+			logger.Error(p.ctx, "Decode crds in chart failed, %+v", err)
+			return nil, nil, "", err
+		}
+		for _, crd := range crds {
+			apiVersions = append(apiVersions, crd.GetAPIVersion())
+			appendCRD(crd)
+		}
+	}
+
+	policy := NewManifestPolicy(p.ctx, p.RuntimeId)
+	var violations []PolicyViolation
 
 	clusterRoles := map[string]*models.ClusterRole{}
 	clusterCommons := map[string]*models.ClusterCommon{}
@@ -115,7 +166,7 @@ func (p *Parser) parseClusterRolesAndClusterCommons(vals map[string]interface{})
 					logger.Error(p.ctx, "Decode file [%s] in chart failed, %+v", filePath, err)
 					return nil, nil, "", err
 				}
-				obj, groupVersionKind, err := decode(doc, nil, nil)
+				obj, groupVersionKind, err := decodeManifest(doc)
 
 				if err != nil {
 					logger.Error(p.ctx, "Decode file [%s] in chart failed, %+v", filePath, err)
@@ -126,6 +177,22 @@ func (p *Parser) parseClusterRolesAndClusterCommons(vals map[string]interface{})
 
 				apiVersions = append(apiVersions, groupVersionKind.GroupVersion().String())
 
+				if policy != nil {
+					objViolations, err := policy.Evaluate(groupVersionKind.GroupKind(), obj)
+					if err != nil {
+						return nil, nil, "", err
+					}
+					violations = append(violations, objViolations...)
+				}
+
+				workload, err := getWorkloadInfo(groupVersionKind.GroupKind(), obj)
+				if err != nil {
+					return nil, nil, "", err
+				}
+				if workload != nil {
+					additionalInfo["workload"] = append(additionalInfo["workload"], workload)
+				}
+
 				switch o := obj.(type) {
 				case *appsv1.Deployment:
 					clusterRole := &models.ClusterRole{
@@ -378,15 +445,25 @@ func (p *Parser) parseClusterRolesAndClusterCommons(vals map[string]interface{})
 						"name":       o.GetObjectMeta().GetName(),
 					})
 				case *corev1.PersistentVolumeClaim:
-					additionalInfo["pvc"] = append(additionalInfo["pvc"], map[string]interface{}{
-						"apiVersion": groupVersionKind.GroupVersion().String(),
-						"name":       o.GetObjectMeta().GetName(),
-					})
+					pvc := getVolumeClaimInfo(o)
+					pvc["apiVersion"] = groupVersionKind.GroupVersion().String()
+					pvc["name"] = o.GetObjectMeta().GetName()
+					additionalInfo["pvc"] = append(additionalInfo["pvc"], pvc)
 				case *exv1beta1.Ingress:
 					additionalInfo["ingress"] = append(additionalInfo["ingress"], map[string]interface{}{
 						"apiVersion": groupVersionKind.GroupVersion().String(),
 						"name":       o.GetObjectMeta().GetName(),
 					})
+				case *unstructured.Unstructured:
+					if isCustomResourceDefinition(groupVersionKind) {
+						appendCRD(o)
+						continue
+					}
+					additionalInfo["custom_resource"] = append(additionalInfo["custom_resource"], map[string]interface{}{
+						"apiVersion": groupVersionKind.GroupVersion().String(),
+						"kind":       groupVersionKind.Kind,
+						"name":       o.GetName(),
+					})
 				default:
 					continue
 				}
@@ -394,16 +471,37 @@ func (p *Parser) parseClusterRolesAndClusterCommons(vals map[string]interface{})
 		}
 	}
 
+	// all the violations are reported at once
+	if len(violations) > 0 {
+		return nil, nil, "", newPolicyError(p.ctx, violations)
+	}
+
+	var providedApiVersions []string
+	for apiVersion := range crdApiVersions {
+		providedApiVersions = append(providedApiVersions, apiVersion)
+	}
+
 	kubeHandler := GetKubeHandler(p.ctx, p.RuntimeId)
-	err = kubeHandler.CheckApiVersionsSupported(apiVersions)
+	err = kubeHandler.CheckApiVersionsSupported(apiVersions, providedApiVersions)
 	if err != nil {
 		return nil, nil, "", err
 	}
 
+	additionalInfo["image"] = getImageInfo(imageRewrites)
+	additionalInfo["lint"] = getLintInfo(p.lintFindings)
+	if p.Provenance != nil {
+		additionalInfo["provenance"] = getProvenanceInfo(p.Provenance)
+	}
+
 	return clusterRoles, clusterCommons, jsonutil.ToString(additionalInfo), nil
 }
 
 func (p *Parser) Parse(clusterWrapper *models.ClusterWrapper, appId string) error {
+	err := checkChartInstallable(p.Chart)
+	if err != nil {
+		return err
+	}
+
 	customVals, name, description, err := p.parseCustomValues()
 	if err != nil {
 		return err
@@ -415,7 +513,20 @@ func (p *Parser) Parse(clusterWrapper *models.ClusterWrapper, appId string) erro
 		}
 	}
 
-	vals, err := p.parseValues(customVals, name)
+	// the api versions served by the crds/ of the chart are not provided to the custom resources when the crds are skipped
+	p.skipCRDs, _ = GetBoolFromValues(customVals, SkipCRDsKey)
+
+	// the reserved keys in Conf are kept in the env of the cluster but not in the values of the chart
+	chartVals := getChartValues(customVals)
+
+	vals, err := p.parseValues(chartVals, name)
+	if err != nil {
+		return err
+	}
+
+	// the lint runs on the chart with the disabled subcharts removed by parseValues, the findings of the lint
+	// are kept in the additional info, for the problems not failing the parse
+	p.lintFindings, err = LintChart(p.Chart, chartVals, p.Namespace)
 	if err != nil {
 		return err
 	}
@@ -455,26 +566,34 @@ func (p *Parser) parseCustomValues() (map[string]interface{}, string, string, er
 	return customVals, name, desc, nil
 }
 
-func (p *Parser) parseValues(customVals map[string]interface{}, name string) (map[string]interface{}, error) {
+func (p *Parser) parseValues(customVals map[string]interface{}, name string) (chartutil.Values, error) {
 	// Get and merge values
-	chartVals, err := chartutil.ReadValues([]byte(p.Chart.Values.GetRaw()))
+	mergedVals := MergeValues(CopyValues(p.Chart.Values), customVals)
+
+	err := chartutil.ProcessDependencies(p.Chart, mergedVals)
 	if err != nil {
 		return nil, err
 	}
 
-	mergedVals := p.mergeValues(chartVals, customVals)
-
-	rawMergedVals, err := yaml.Marshal(mergedVals)
+	// validate the values of the chart and the subcharts enabled before the lint and the rendering,
+	// which report the violations in a plain error
+	coalescedVals, err := chartutil.CoalesceValues(p.Chart, CopyValues(mergedVals))
 	if err != nil {
 		return nil, err
 	}
-
-	config := &chart.Config{Raw: string(rawMergedVals), Values: map[string]*chart.Value{}}
+	violations, err := ValidateValuesSchema(p.Chart, coalescedVals)
+	if err != nil {
+		return nil, err
+	}
+	if len(violations) > 0 {
+		return nil, newSchemaError(p.ctx, violations)
+	}
 
 	// Get release option
 	options := chartutil.ReleaseOptions{
 		Name:      name,
 		Namespace: p.Namespace,
+		IsInstall: true,
 	}
 
 	kubeHandler := GetKubeHandler(p.ctx, p.RuntimeId)
@@ -483,38 +602,19 @@ func (p *Parser) parseValues(customVals map[string]interface{}, name string) (ma
 		return nil, err
 	}
 
-	caps := &chartutil.Capabilities{APIVersions: chartutil.DefaultVersionSet, KubeVersion: version}
+	caps := &chartutil.Capabilities{
+		APIVersions: chartutil.DefaultVersionSet,
+		KubeVersion: chartutil.KubeVersion{
+			Version: version.GitVersion,
+			Major:   version.Major,
+			Minor:   version.Minor,
+		},
+	}
 
-	vals, err := chartutil.ToRenderValuesCaps(p.Chart, config, options, caps)
+	vals, err := chartutil.ToRenderValues(p.Chart, mergedVals, options, caps)
 	if err != nil {
 		return nil, err
 	}
 
 	return vals, nil
 }
-
-func (p *Parser) mergeValues(dest map[string]interface{}, src map[string]interface{}) map[string]interface{} {
-	for k, v := range src {
-		// If the key doesn't exist already, then just set the key to that value
-		if _, exists := dest[k]; !exists {
-			dest[k] = v
-			continue
-		}
-		nextMap, ok := v.(map[string]interface{})
-		// If it isn't another map, overwrite the value
-		if !ok {
-			dest[k] = v
-			continue
-		}
-		// Edge case: If the key exists in the destination, but isn't a map
-		destMap, isMap := dest[k].(map[string]interface{})
-		// If the source map has a map for this key, prefer it
-		if !isMap {
-			dest[k] = v
-			continue
-		}
-		// If we got to this point, it is a map in both, so merge them
-		dest[k] = p.mergeValues(destMap, nextMap)
-	}
-	return dest
-}
@@ -0,0 +1,195 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"helm.sh/helm/pkg/releaseutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/util/stringutil"
+)
+
+// the rules of the manifest policy
+const (
+	PolicyRulePrivileged     = "privileged"
+	PolicyRuleHostNetwork    = "host_network"
+	PolicyRuleHostPath       = "host_path"
+	PolicyRuleResourceLimits = "resource_limits"
+	PolicyRuleServiceType    = "service_type"
+)
+
+// PolicyViolation is an object in the manifests violating a rule of the manifest policy
+type PolicyViolation struct {
+	Kind    string
+	Name    string
+	Rule    string
+	Message string
+}
+
+func (v PolicyViolation) String() string {
+	return fmt.Sprintf("%s/%s violates [%s]: %s", v.Kind, v.Name, v.Rule, v.Message)
+}
+
+// ManifestPolicy evaluates the objects rendered from the charts against the manifest policy of a runtime,
+// as a post renderer it fails the install and the upgrade of the manifests violating the policy
+type ManifestPolicy struct {
+	ctx     context.Context
+	Options *ManifestPolicyOptions
+}
+
+func NewManifestPolicy(ctx context.Context, runtimeId string) *ManifestPolicy {
+	options := GetRuntimeOptions(runtimeId).ManifestPolicy
+	if options == nil {
+		return nil
+	}
+	return &ManifestPolicy{ctx: ctx, Options: options}
+}
+
+// Run returns the manifests as they are, or the error of all their violations
+func (p *ManifestPolicy) Run(manifests []byte) ([]byte, error) {
+	violations, err := p.EvaluateManifests(manifests)
+	if err != nil {
+		return nil, err
+	}
+	if len(violations) > 0 {
+		return nil, newPolicyError(p.ctx, violations)
+	}
+	return manifests, nil
+}
+
+// EvaluateManifests returns the violations of the objects in the manifests, the documents without kind are skipped
+func (p *ManifestPolicy) EvaluateManifests(manifests []byte) ([]PolicyViolation, error) {
+	docs := releaseutil.SplitManifests(string(manifests))
+
+	var violations []PolicyViolation
+	for i := 0; i < len(docs); i++ {
+		doc := []byte(docs[fmt.Sprintf("manifest-%d", i)])
+		var head releaseutil.SimpleHead
+		err := yaml.Unmarshal(doc, &head)
+		if err != nil {
+			return nil, err
+		}
+		if head.Kind == "" {
+			continue
+		}
+
+		obj, groupVersionKind, err := decodeManifest(doc)
+		if err != nil {
+			return nil, err
+		}
+		objViolations, err := p.Evaluate(groupVersionKind.GroupKind(), obj)
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, objViolations...)
+	}
+	return violations, nil
+}
+
+// Evaluate returns the violations of the object decoded from the manifests, typed or unstructured
+func (p *ManifestPolicy) Evaluate(groupKind schema.GroupKind, obj runtime.Object) ([]PolicyViolation, error) {
+	var u map[string]interface{}
+	if o, ok := obj.(*unstructured.Unstructured); ok {
+		u = o.Object
+	} else {
+		var err error
+		u, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
+	}
+	name, _, _ := unstructured.NestedString(u, "metadata", "name")
+
+	var violations []PolicyViolation
+	violate := func(rule, format string, args ...interface{}) {
+		violations = append(violations, PolicyViolation{
+			Kind:    groupKind.Kind,
+			Name:    name,
+			Rule:    rule,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if groupKind == (schema.GroupKind{Kind: "Service"}) {
+		serviceType, _, _ := unstructured.NestedString(u, "spec", "type")
+		if serviceType != "" && stringutil.StringIn(serviceType, p.Options.DeniedServiceTypes) {
+			violate(PolicyRuleServiceType, "service type [%s] is not allowed", serviceType)
+		}
+		return violations, nil
+	}
+
+	podSpecPath, ok := podSpecPaths[groupKind]
+	if !ok {
+		return nil, nil
+	}
+	podSpec, _, err := unstructured.NestedMap(u, podSpecPath...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod spec of [%s/%s]: %+v", groupKind.Kind, name, err)
+	}
+
+	if hostNetwork, _, _ := unstructured.NestedBool(podSpec, "hostNetwork"); hostNetwork && p.Options.DenyHostNetwork {
+		violate(PolicyRuleHostNetwork, "host network is not allowed")
+	}
+
+	if p.Options.DenyHostPath {
+		volumes, _, _ := unstructured.NestedSlice(podSpec, "volumes")
+		for _, v := range volumes {
+			volume, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if _, ok := volume["hostPath"]; ok {
+				violate(PolicyRuleHostPath, "volume [%v] mounts host path", volume["name"])
+			}
+		}
+	}
+
+	for _, field := range containerFields {
+		containers, _, _ := unstructured.NestedSlice(podSpec, field)
+		for _, c := range containers {
+			container, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			privileged, _, _ := unstructured.NestedBool(container, "securityContext", "privileged")
+			if privileged && p.Options.DenyPrivileged {
+				violate(PolicyRulePrivileged, "container [%v] is privileged", container["name"])
+			}
+
+			// ephemeral containers have no resources
+			if p.Options.RequireLimits && field != "ephemeralContainers" {
+				limits, _, _ := unstructured.NestedMap(container, "resources", "limits")
+				var missing []string
+				for _, resource := range []string{"cpu", "memory"} {
+					if _, ok := limits[resource]; !ok {
+						missing = append(missing, resource)
+					}
+				}
+				if len(missing) > 0 {
+					violate(PolicyRuleResourceLimits, "container [%v] has no limits of %s", container["name"], strings.Join(missing, ", "))
+				}
+			}
+		}
+	}
+	return violations, nil
+}
+
+// newPolicyError reports all the violations in one error with a detail for every violation
+func newPolicyError(ctx context.Context, violations []PolicyViolation) error {
+	var causes []string
+	for _, violation := range violations {
+		causes = append(causes, violation.String())
+	}
+	return newDetailedError(ctx, gerr.PermissionDenied, gerr.ErrorValidateFailed, causes)
+}
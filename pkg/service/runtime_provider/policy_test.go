@@ -0,0 +1,166 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+)
+
+const testPrivilegedDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: agent
+spec:
+  selector:
+    matchLabels:
+      app: agent
+  template:
+    metadata:
+      labels:
+        app: agent
+    spec:
+      hostNetwork: true
+      initContainers:
+      - name: init
+        image: busybox
+        resources:
+          limits:
+            cpu: 100m
+            memory: 64Mi
+      containers:
+      - name: agent
+        image: agent:1.0
+        securityContext:
+          privileged: true
+        resources:
+          limits:
+            cpu: 500m
+      volumes:
+      - name: proc
+        hostPath:
+          path: /proc
+      - name: data
+        emptyDir: {}
+`
+
+const testCompliantPod = `apiVersion: v1
+kind: Pod
+metadata:
+  name: nginx
+spec:
+  containers:
+  - name: nginx
+    image: nginx:1.15
+    resources:
+      limits:
+        cpu: 500m
+        memory: 128Mi
+`
+
+const testLoadBalancerService = `apiVersion: v1
+kind: Service
+metadata:
+  name: nginx
+spec:
+  type: LoadBalancer
+  ports:
+  - port: 80
+`
+
+func evaluateTestManifest(t *testing.T, policy *ManifestPolicy, manifest string) []PolicyViolation {
+	obj, groupVersionKind, err := decodeManifest([]byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	violations, err := policy.Evaluate(groupVersionKind.GroupKind(), obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return violations
+}
+
+func TestManifestPolicy(t *testing.T) {
+	policy := &ManifestPolicy{Options: &ManifestPolicyOptions{
+		DenyPrivileged:     true,
+		DenyHostNetwork:    true,
+		DenyHostPath:       true,
+		RequireLimits:      true,
+		DeniedServiceTypes: []string{"LoadBalancer"},
+	}}
+
+	violations := evaluateTestManifest(t, policy, testPrivilegedDeployment)
+	var rules []string
+	for _, violation := range violations {
+		if violation.Kind != "Deployment" || violation.Name != "agent" {
+			t.Errorf("unexpected object of violation [%+v]", violation)
+		}
+		rules = append(rules, violation.Rule)
+	}
+	sort.Strings(rules)
+	expected := []string{PolicyRuleHostNetwork, PolicyRuleHostPath, PolicyRulePrivileged, PolicyRuleResourceLimits}
+	if strings.Join(rules, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected violations of rules [%+v], got [%+v]", expected, violations)
+	}
+
+	violations = evaluateTestManifest(t, policy, testLoadBalancerService)
+	if len(violations) != 1 || violations[0].Rule != PolicyRuleServiceType {
+		t.Errorf("expected violation of service type, got [%+v]", violations)
+	}
+
+	for _, manifest := range []string{
+		testCompliantPod,
+		"apiVersion: stable.example.com/v1\nkind: CronTab\nmetadata:\n  name: backup\n",
+		// the custom resource of the same kind as a workload
+		strings.Replace(testPrivilegedDeployment, "apiVersion: apps/v1", "apiVersion: stable.example.com/v1", 1),
+	} {
+		violations = evaluateTestManifest(t, policy, manifest)
+		if len(violations) > 0 {
+			t.Errorf("expected no violation, got [%+v]", violations)
+		}
+	}
+
+	// the rules not enabled are not evaluated
+	policy = &ManifestPolicy{Options: &ManifestPolicyOptions{DenyHostPath: true}}
+	violations = evaluateTestManifest(t, policy, testPrivilegedDeployment)
+	if len(violations) != 1 || violations[0].Rule != PolicyRuleHostPath || !strings.Contains(violations[0].Message, "proc") {
+		t.Errorf("expected violation of host path only, got [%+v]", violations)
+	}
+
+	err := newPolicyError(context.Background(), violations)
+	if !gerr.IsGRPCError(err) || !strings.Contains(err.Error(), "Deployment/agent") {
+		t.Errorf("expected grpc error of the violations, got [%+v]", err)
+	}
+}
+
+func TestManifestPolicyRun(t *testing.T) {
+	policy := &ManifestPolicy{
+		ctx:     context.Background(),
+		Options: &ManifestPolicyOptions{DeniedServiceTypes: []string{"LoadBalancer"}},
+	}
+
+	manifests := "---\n# Source: test/templates/pod.yaml\n" + testCompliantPod + "---\n# Source: test/templates/empty.yaml\n"
+	out, err := policy.Run([]byte(manifests))
+	if err != nil || string(out) != manifests {
+		t.Errorf("expected compliant manifests returned as they are, got [%s] [%+v]", out, err)
+	}
+
+	manifests += "---\n# Source: test/templates/service.yaml\n" + testLoadBalancerService
+	violations, err := policy.EvaluateManifests([]byte(manifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || violations[0].Kind != "Service" || violations[0].Rule != PolicyRuleServiceType {
+		t.Errorf("expected violation of service type, got [%+v]", violations)
+	}
+	_, err = policy.Run([]byte(manifests))
+	if !gerr.IsGRPCError(err) || !strings.Contains(err.Error(), "Service/nginx") {
+		t.Errorf("expected grpc error of the violations, got [%+v]", err)
+	}
+}
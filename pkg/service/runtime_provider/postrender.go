@@ -0,0 +1,331 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/pkg/action"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/kube"
+	"helm.sh/helm/pkg/release"
+	"helm.sh/helm/pkg/releaseutil"
+	"helm.sh/helm/pkg/storage/driver"
+	"k8s.io/cli-runtime/pkg/kustomize/k8sdeps"
+	"sigs.k8s.io/kustomize/pkg/constants"
+	"sigs.k8s.io/kustomize/pkg/fs"
+	"sigs.k8s.io/kustomize/pkg/loader"
+	"sigs.k8s.io/kustomize/pkg/target"
+	"sigs.k8s.io/kustomize/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// PostRenderRoot is the dir of the kustomization in the in-memory file system of the post render
+	PostRenderRoot = "/kustomization"
+	// RenderedManifestsFile is the resource of the kustomization holding the manifests rendered from the chart
+	RenderedManifestsFile = "helm-rendered.yaml"
+)
+
+// KustomizePostRenderer applies the kustomization in Dir to the manifests rendered from the charts,
+// the files of the kustomization are loaded for every render so that changes apply without restart
+type KustomizePostRenderer struct {
+	Dir string
+}
+
+func NewKustomizePostRenderer(runtimeId string) *KustomizePostRenderer {
+	postRender := GetRuntimeOptions(runtimeId).PostRender
+	if postRender == nil || postRender.Kustomization == "" {
+		return nil
+	}
+	return &KustomizePostRenderer{Dir: postRender.Kustomization}
+}
+
+// Run returns the manifests patched by the kustomization
+func (r *KustomizePostRenderer) Run(manifests []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(manifests)) == 0 {
+		return manifests, nil
+	}
+
+	fSys, err := r.loadKustomization(manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := buildKustomization(fSys)
+	if err != nil {
+		return nil, fmt.Errorf("post render by kustomization [%s] failed: %+v", r.Dir, err)
+	}
+	return out, nil
+}
+
+// buildKustomization builds the kustomization at PostRenderRoot the same way as "kustomize build"
+func buildKustomization(fSys fs.FileSystem) ([]byte, error) {
+	ldr, err := loader.NewLoader(PostRenderRoot, fSys)
+	if err != nil {
+		return nil, err
+	}
+	defer ldr.Cleanup()
+
+	f := k8sdeps.NewFactory()
+	kt, err := target.NewKustTarget(ldr, fSys, f.ResmapF, f.TransformerF)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := kt.MakeCustomizedResMap()
+	if err != nil {
+		return nil, err
+	}
+	return resources.EncodeAsYaml()
+}
+
+// RenderFiles post renders the yaml files rendered by the engine as a whole, the result is a single file. The hooks are
+// kept in their files as they are, the same as they are deployed by the install and the upgrade
+func (r *KustomizePostRenderer) RenderFiles(files map[string]string) (map[string]string, error) {
+	var names []string
+	for name, content := range files {
+		if filepath.Ext(name) != ".yaml" || len(strings.TrimSpace(content)) == 0 {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	renderedFiles := make(map[string]string)
+	var manifests bytes.Buffer
+	for _, name := range names {
+		docs := releaseutil.SplitManifests(files[name])
+		var hooks []string
+		for i := 0; i < len(docs); i++ {
+			doc := docs[fmt.Sprintf("manifest-%d", i)]
+			if isHookManifest(doc) {
+				hooks = append(hooks, doc)
+			} else {
+				fmt.Fprintf(&manifests, "---\n# Source: %s\n%s\n", name, doc)
+			}
+		}
+		if len(hooks) > 0 {
+			renderedFiles[name] = strings.Join(hooks, "\n---\n") + "\n"
+		}
+	}
+
+	out, err := r.Run(manifests.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	renderedFiles[RenderedManifestsFile] = string(out)
+	return renderedFiles, nil
+}
+
+// isHookManifest reports whether the manifest is a hook, which helm splits out of the manifest of the release
+func isHookManifest(manifest string) bool {
+	var head releaseutil.SimpleHead
+	err := yaml.Unmarshal([]byte(manifest), &head)
+	if err != nil || head.Metadata == nil {
+		return false
+	}
+	_, ok := head.Metadata.Annotations[release.HookAnnotation]
+	return ok
+}
+
+// loadKustomization copies the files of the kustomization into an in-memory file system,
+// with the rendered manifests added to the resources of the kustomization
+func (r *KustomizePostRenderer) loadKustomization(manifests []byte) (fs.FileSystem, error) {
+	fSys := fs.MakeFakeFS()
+	err := filepath.Walk(r.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(r.Dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return fSys.WriteFile(filepath.Join(PostRenderRoot, rel), data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load kustomization [%s] failed: %+v", r.Dir, err)
+	}
+
+	var kustFile string
+	for _, name := range []string{constants.KustomizationFileName, constants.SecondaryKustomizationFileName} {
+		if fSys.Exists(filepath.Join(PostRenderRoot, name)) {
+			kustFile = filepath.Join(PostRenderRoot, name)
+			break
+		}
+	}
+	if kustFile == "" {
+		return nil, fmt.Errorf("no kustomization.yaml file under [%s]", r.Dir)
+	}
+
+	data, err := fSys.ReadFile(kustFile)
+	if err != nil {
+		return nil, err
+	}
+	var kustomization types.Kustomization
+	err = yaml.Unmarshal(data, &kustomization)
+	if err != nil {
+		return nil, fmt.Errorf("decode kustomization [%s] failed: %+v", r.Dir, err)
+	}
+	kustomization.Resources = append(kustomization.Resources, RenderedManifestsFile)
+	data, err = yaml.Marshal(kustomization)
+	if err != nil {
+		return nil, err
+	}
+
+	// kustomize reads kustomization.yaml ahead of kustomization.yml
+	err = fSys.WriteFile(filepath.Join(PostRenderRoot, constants.KustomizationFileName), data)
+	if err != nil {
+		return nil, err
+	}
+	err = fSys.WriteFile(filepath.Join(PostRenderRoot, RenderedManifestsFile), manifests)
+	if err != nil {
+		return nil, err
+	}
+	return fSys, nil
+}
+
+// PostRenderer changes the manifests rendered from the charts before they are built into the resources
+type PostRenderer interface {
+	Run(manifests []byte) ([]byte, error)
+}
+
+// getPostRenderers returns the post renderers of the runtime in order, the kustomization runs ahead of the image rewrite
+// so that the images set by the kustomization are rewritten as well, and the manifest policy evaluates the objects
+// as they are deployed at last
+func getPostRenderers(ctx context.Context, runtimeId string) []PostRenderer {
+	var postRenderers []PostRenderer
+	if kustomizePostRenderer := NewKustomizePostRenderer(runtimeId); kustomizePostRenderer != nil {
+		postRenderers = append(postRenderers, kustomizePostRenderer)
+	}
+	if imageRewriter := NewImageRewriter(ctx, runtimeId); imageRewriter != nil {
+		postRenderers = append(postRenderers, imageRewriter)
+	}
+	if policy := NewManifestPolicy(ctx, runtimeId); policy != nil {
+		postRenderers = append(postRenderers, policy)
+	}
+	return postRenderers
+}
+
+// postRenderKubeClient post renders the manifest of the release rendered by an install or an upgrade, which is the first
+// manifest built other than the custom resource definitions. The definitions, the hooks and the manifests of the releases
+// stored are built as they are, so that the releases are upgraded, rolled back and uninstalled as they were deployed.
+// The hooks are post rendered by the hook post renderers once, when the release is stored ahead of running them
+type postRenderKubeClient struct {
+	kube.Interface
+	postRenderers     []PostRenderer
+	hookPostRenderers []PostRenderer
+	crds              map[string]bool
+
+	postRendered bool
+	rendered     string
+	manifest     string
+}
+
+func (c *postRenderKubeClient) Build(reader io.Reader) (kube.ResourceList, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	manifest := string(data)
+
+	switch {
+	case c.crds[manifest]:
+	case !c.postRendered:
+		for _, postRenderer := range c.postRenderers {
+			data, err = postRenderer.Run(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		c.postRendered = true
+		c.rendered, c.manifest = manifest, string(data)
+		manifest = c.manifest
+	case manifest == c.rendered:
+		manifest = c.manifest
+	}
+	return c.Interface.Build(strings.NewReader(manifest))
+}
+
+// postRenderHooks post renders the manifests of the hooks by the hook post renderers, the errors are returned as they are
+// for the violations of the manifest policy
+func (c *postRenderKubeClient) postRenderHooks(hooks []*release.Hook) error {
+	for _, hook := range hooks {
+		data := []byte(hook.Manifest)
+		var err error
+		for _, postRenderer := range c.hookPostRenderers {
+			data, err = postRenderer.Run(data)
+			if err != nil {
+				return err
+			}
+		}
+		hook.Manifest = string(data)
+	}
+	return nil
+}
+
+// postRenderDriver stores the release created by the install or the upgrade with the manifest and the hooks post rendered
+type postRenderDriver struct {
+	driver.Driver
+	kubeClient *postRenderKubeClient
+}
+
+func (d *postRenderDriver) Create(key string, rls *release.Release) error {
+	// the release is kept by the install and the upgrade, which build and update it with the manifest stored
+	// and run the hooks stored
+	if d.kubeClient.postRendered && rls.Manifest == d.kubeClient.rendered && rls.Info != nil &&
+		(rls.Info.Status == release.StatusPendingInstall || rls.Info.Status == release.StatusPendingUpgrade) {
+		rls.Manifest = d.kubeClient.manifest
+		err := d.kubeClient.postRenderHooks(rls.Hooks)
+		if err != nil {
+			return err
+		}
+	}
+	return d.Driver.Create(key, rls)
+}
+
+// withPostRenderers returns a copy of the action configuration for an install or an upgrade of the chart, which deploys
+// and stores the release post rendered by the renderers. The cached configuration is shared by the handlers of the runtime
+// and left as it is
+func withPostRenderers(cfg *action.Configuration, c *chart.Chart, postRenderers []PostRenderer) *action.Configuration {
+	if len(postRenderers) == 0 {
+		return cfg
+	}
+
+	kubeClient := &postRenderKubeClient{
+		Interface:     cfg.KubeClient,
+		postRenderers: postRenderers,
+		crds:          make(map[string]bool),
+	}
+	for _, postRenderer := range postRenderers {
+		// the images of the hooks are rewritten and the hooks evaluated as the release, while the kustomization
+		// patches the resources of the release only, the same as at parse
+		switch postRenderer.(type) {
+		case *ImageRewriter, *ManifestPolicy:
+			kubeClient.hookPostRenderers = append(kubeClient.hookPostRenderers, postRenderer)
+		}
+	}
+	for _, crd := range c.CRDs() {
+		kubeClient.crds[string(crd.Data)] = true
+	}
+	releases := *cfg.Releases
+	releases.Driver = &postRenderDriver{Driver: cfg.Releases.Driver, kubeClient: kubeClient}
+
+	postRenderCfg := *cfg
+	postRenderCfg.KubeClient = kubeClient
+	postRenderCfg.Releases = &releases
+	return &postRenderCfg
+}
@@ -0,0 +1,302 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"helm.sh/helm/pkg/action"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/kube"
+	kubefake "helm.sh/helm/pkg/kube/fake"
+)
+
+const testKustomization = `commonLabels:
+  team: platform
+commonAnnotations:
+  owner: platform@openpitrix.io
+imageTags:
+- name: nginx
+  newTag: "1.17"
+patchesStrategicMerge:
+- tolerations.yaml
+`
+
+const testTolerationsPatch = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+spec:
+  template:
+    spec:
+      tolerations:
+      - key: dedicated
+        operator: Exists
+`
+
+const testDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx
+spec:
+  selector:
+    matchLabels:
+      app: nginx
+  template:
+    metadata:
+      labels:
+        app: nginx
+    spec:
+      containers:
+      - name: nginx
+        image: nginx:1.15
+`
+
+func newTestKustomization(t *testing.T) *KustomizePostRenderer {
+	dir, err := ioutil.TempDir("", "kustomization")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(testKustomization), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "tolerations.yaml"), []byte(testTolerationsPatch), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &KustomizePostRenderer{Dir: dir}
+}
+
+func checkPostRendered(t *testing.T, manifests string) {
+	for _, expected := range []string{"team: platform", "owner: platform@openpitrix.io", "image: nginx:1.17", "key: dedicated"} {
+		if !strings.Contains(manifests, expected) {
+			t.Errorf("expected [%s] in post rendered manifests [%s]", expected, manifests)
+		}
+	}
+}
+
+func TestKustomizePostRenderer(t *testing.T) {
+	r := newTestKustomization(t)
+	defer os.RemoveAll(r.Dir)
+
+	out, err := r.Run([]byte(testDeployment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPostRendered(t, string(out))
+
+	files, err := r.RenderFiles(map[string]string{
+		"test/templates/deployment.yaml": testDeployment,
+		"test/templates/empty.yaml":      "\n",
+		"test/templates/NOTES.txt":       "installed",
+		"test/templates/hook.yaml":       testHook,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected post rendered manifests in a single file and the hooks apart, got [%+v]", files)
+	}
+	checkPostRendered(t, files[RenderedManifestsFile])
+	// the hooks are not post rendered by install and upgrade either
+	if files["test/templates/hook.yaml"] != testHook || strings.Contains(files[RenderedManifestsFile], "nginx-test") {
+		t.Errorf("expected hook kept as it is, got [%+v]", files)
+	}
+
+	out, err = r.Run(nil)
+	if err != nil || len(out) != 0 {
+		t.Errorf("expected empty manifests not post rendered, got [%s] [%+v]", out, err)
+	}
+
+	err = os.Remove(filepath.Join(r.Dir, "kustomization.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Run([]byte(testDeployment))
+	if err == nil {
+		t.Errorf("expected error for dir without kustomization")
+	}
+}
+
+type recordingKubeClient struct {
+	kubefake.PrintingKubeClient
+	manifests []string
+}
+
+func (c *recordingKubeClient) Build(reader io.Reader) (kube.ResourceList, error) {
+	manifests, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	c.manifests = append(c.manifests, string(manifests))
+	return c.PrintingKubeClient.Build(reader)
+}
+
+const testHook = `apiVersion: v1
+kind: Pod
+metadata:
+  name: nginx-test
+  annotations:
+    "helm.sh/hook": pre-install,pre-upgrade
+spec:
+  containers:
+  - name: test
+    image: nginx:1.15
+  restartPolicy: Never
+`
+
+// countingPostRenderer counts the runs of the post renderer
+type countingPostRenderer struct {
+	PostRenderer
+	runs int
+}
+
+func (r *countingPostRenderer) Run(manifests []byte) ([]byte, error) {
+	r.runs++
+	return r.PostRenderer.Run(manifests)
+}
+
+func TestWithPostRenderers(t *testing.T) {
+	r := &countingPostRenderer{PostRenderer: newTestKustomization(t)}
+	defer os.RemoveAll(r.PostRenderer.(*KustomizePostRenderer).Dir)
+
+	c := newTestChart()
+	c.Templates = []*chart.File{
+		{Name: "templates/deployment.yaml", Data: []byte(testDeployment)},
+		{Name: "templates/hook.yaml", Data: []byte(testHook)},
+	}
+	c.Files = []*chart.File{{Name: "crds/crd.yaml", Data: []byte(testCRD)}}
+
+	cfg := newTestActionConfig()
+	if withPostRenderers(cfg, c, nil) != cfg {
+		t.Errorf("expected action config not changed without post renderer")
+	}
+
+	kubeClient := &recordingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}}
+	cfg.KubeClient = kubeClient
+	releases := cfg.Releases
+	postRenderCfg := withPostRenderers(cfg, c, []PostRenderer{r})
+	if cfg.KubeClient != kubeClient || cfg.Releases != releases {
+		t.Errorf("expected cached action config not changed")
+	}
+
+	// the crds are built as they are
+	_, err := postRenderCfg.KubeClient.Build(strings.NewReader(testCRD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.runs != 0 || kubeClient.manifests[0] != testCRD {
+		t.Errorf("expected crd built as it is, got [%s]", kubeClient.manifests[0])
+	}
+
+	installClient := action.NewInstall(postRenderCfg)
+	installClient.ReleaseName = "nginx"
+	installClient.Namespace = "default"
+	_, err = installClient.Run(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	installed, err := releases.Get("nginx", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.runs != 1 {
+		t.Errorf("expected release post rendered once by install, got [%d]", r.runs)
+	}
+	checkPostRendered(t, installed.Manifest)
+	if len(installed.Hooks) != 1 || strings.Contains(installed.Hooks[0].Manifest, "team: platform") {
+		t.Fatalf("expected hook not post rendered, got [%+v]", installed.Hooks)
+	}
+
+	// the upgrade builds the release stored as it is, and post renders the release upgraded once
+	kubeClient.manifests = nil
+	r.runs = 0
+	updateClient := action.NewUpgrade(withPostRenderers(cfg, c, []PostRenderer{r}))
+	updateClient.Namespace = "default"
+	_, err = updateClient.Run("nginx", c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := releases.Get("nginx", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.runs != 1 {
+		t.Errorf("expected release post rendered once by upgrade, got [%d]", r.runs)
+	}
+	checkPostRendered(t, upgraded.Manifest)
+	for _, manifest := range kubeClient.manifests {
+		if manifest != installed.Manifest && manifest != upgraded.Manifest && manifest != installed.Hooks[0].Manifest {
+			t.Errorf("expected the manifests stored built by upgrade, got [%s]", manifest)
+		}
+	}
+
+	// the uninstall deletes the release stored, which is post rendered
+	kubeClient.manifests = nil
+	_, err = action.NewUninstall(cfg).Run("nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kubeClient.manifests) == 0 || !strings.Contains(kubeClient.manifests[0], "key: dedicated") {
+		t.Errorf("expected the manifest stored built by uninstall, got [%+v]", kubeClient.manifests)
+	}
+}
+
+func TestWithPostRenderersHooks(t *testing.T) {
+	r := newTestKustomization(t)
+	defer os.RemoveAll(r.Dir)
+	imageRewriter := &ImageRewriter{
+		ctx:     context.Background(),
+		Options: &ImageRewriteOptions{Registries: map[string]string{"docker.io/": "mirror.local/"}},
+		digests: make(map[string]string),
+	}
+
+	c := newTestChart()
+	c.Templates = []*chart.File{
+		{Name: "templates/deployment.yaml", Data: []byte(testDeployment)},
+		{Name: "templates/hook.yaml", Data: []byte(testHook)},
+	}
+
+	cfg := newTestActionConfig()
+	kubeClient := &recordingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}}
+	cfg.KubeClient = kubeClient
+	installClient := action.NewInstall(withPostRenderers(cfg, c, []PostRenderer{r, imageRewriter}))
+	installClient.ReleaseName = "nginx"
+	installClient.Namespace = "default"
+	_, err := installClient.Run(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	installed, err := cfg.Releases.Get("nginx", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(installed.Manifest, "image: mirror.local/library/nginx:1.17") {
+		t.Errorf("expected release post rendered, got [%s]", installed.Manifest)
+	}
+
+	// the images of the hooks are rewritten, the kustomization is not applied to them
+	if len(installed.Hooks) != 1 {
+		t.Fatalf("expected hook stored, got [%+v]", installed.Hooks)
+	}
+	hook := installed.Hooks[0].Manifest
+	if !strings.Contains(hook, "image: mirror.local/library/nginx:1.15") || strings.Contains(hook, "team: platform") {
+		t.Errorf("expected image of hook rewritten only, got [%s]", hook)
+	}
+	var built bool
+	for _, manifest := range kubeClient.manifests {
+		built = built || manifest == hook
+	}
+	if !built {
+		t.Errorf("expected hook built as it is stored, got [%+v]", kubeClient.manifests)
+	}
+}
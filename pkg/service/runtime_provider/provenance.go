@@ -0,0 +1,137 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chart/loader"
+	"helm.sh/helm/pkg/downloader"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/logger"
+	"openpitrix.io/openpitrix/pkg/util/jsonutil"
+)
+
+// ProvenanceAnnotation is the annotation of the chart in the release keeping the provenance verified at install or upgrade
+const ProvenanceAnnotation = "openpitrix.io/provenance"
+
+// ChartProvenance is the signer and the digest of a chart package verified by its provenance file
+type ChartProvenance struct {
+	SignedBy string `json:"signed_by"`
+	KeyId    string `json:"key_id"`
+	Digest   string `json:"digest"`
+}
+
+// VerifyChartPackage verifies the package against its provenance file in the dir of the policy and the keyring,
+// the same way as "helm verify"
+func VerifyChartPackage(options *ProvenanceOptions, pkg []byte) (*ChartProvenance, error) {
+	c, err := loader.LoadArchive(bytes.NewReader(pkg))
+	if err != nil {
+		return nil, err
+	}
+	// the provenance file signs the package by its file name
+	filename := fmt.Sprintf("%s-%s.tgz", c.Name(), c.Metadata.Version)
+
+	prov, err := ioutil.ReadFile(filepath.Join(options.Dir, filename+".prov"))
+	if err != nil {
+		return nil, fmt.Errorf("provenance file of chart [%s] not found: %+v", filename, err)
+	}
+
+	dir, err := ioutil.TempDir("", "chart-provenance")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	chartPath := filepath.Join(dir, filename)
+	err = ioutil.WriteFile(chartPath, pkg, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(chartPath+".prov", prov, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// action.Verify drops the verification, which has the signer
+	verification, err := downloader.VerifyChart(chartPath, options.Keyring)
+	if err != nil {
+		return nil, fmt.Errorf("verify chart [%s] failed: %+v", filename, err)
+	}
+
+	var identities []string
+	for name := range verification.SignedBy.Identities {
+		identities = append(identities, name)
+	}
+	sort.Strings(identities)
+
+	return &ChartProvenance{
+		SignedBy: strings.Join(identities, ", "),
+		KeyId:    verification.SignedBy.PrimaryKey.KeyIdString(),
+		Digest:   verification.FileHash,
+	}, nil
+}
+
+// verifyChartProvenance verifies the package when the runtime requires signed charts, nil is returned otherwise
+func verifyChartProvenance(ctx context.Context, runtimeId string, pkg []byte) (*ChartProvenance, error) {
+	return verifyPackageProvenance(ctx, GetRuntimeOptions(runtimeId).Provenance, pkg)
+}
+
+// verifyPackageProvenance verifies the package against the policy, nil is returned when the policy has no keyring
+func verifyPackageProvenance(ctx context.Context, options *ProvenanceOptions, pkg []byte) (*ChartProvenance, error) {
+	if options == nil || options.Keyring == "" {
+		return nil, nil
+	}
+
+	provenance, err := VerifyChartPackage(options, pkg)
+	if err != nil {
+		logger.Error(ctx, "Verify provenance of chart failed: %+v", err)
+		return nil, gerr.NewWithDetail(ctx, gerr.PermissionDenied, err, gerr.ErrorValidateFailed)
+	}
+	logger.Info(ctx, "Verified chart with digest [%s] signed by [%s]", provenance.Digest, provenance.SignedBy)
+	return provenance, nil
+}
+
+// setChartProvenance keeps the provenance in the annotations of the chart, which is stored with the release
+func setChartProvenance(c *chart.Chart, provenance *ChartProvenance) {
+	if provenance == nil {
+		delete(c.Metadata.Annotations, ProvenanceAnnotation)
+		return
+	}
+	if c.Metadata.Annotations == nil {
+		c.Metadata.Annotations = make(map[string]string)
+	}
+	c.Metadata.Annotations[ProvenanceAnnotation] = jsonutil.ToString(provenance)
+}
+
+// getChartProvenance returns the provenance kept by setChartProvenance, nil if the chart was not verified
+func getChartProvenance(c *chart.Chart) *ChartProvenance {
+	if c == nil || c.Metadata == nil || c.Metadata.Annotations[ProvenanceAnnotation] == "" {
+		return nil
+	}
+	var provenance ChartProvenance
+	err := jsonutil.Decode([]byte(c.Metadata.Annotations[ProvenanceAnnotation]), &provenance)
+	if err != nil {
+		return nil
+	}
+	return &provenance
+}
+
+func getProvenanceInfo(provenance *ChartProvenance) []map[string]interface{} {
+	return []map[string]interface{}{{
+		"signed_by": provenance.SignedBy,
+		"key_id":    provenance.KeyId,
+		"digest":    provenance.Digest,
+	}}
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"helm.sh/helm/pkg/provenance"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+)
+
+// newTestProvenance signs the package by a new key, and returns the policy with the provenance file and the keyring
+func newTestProvenance(t *testing.T, pkg []byte) *ProvenanceOptions {
+	dir, err := ioutil.TempDir("", "chart-provenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity, err := openpgp.NewEntity("Test", "", "test@openpitrix.io", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := os.Create(filepath.Join(dir, "pubring.gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyring.Close()
+	err = entity.Serialize(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chartPath := filepath.Join(dir, "test-0.1.0.tgz")
+	err = ioutil.WriteFile(chartPath, pkg, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prov, err := (&provenance.Signatory{Entity: entity}).ClearSign(chartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(chartPath+".prov", []byte(prov), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &ProvenanceOptions{Keyring: keyring.Name(), Dir: dir}
+}
+
+func TestVerifyChartPackage(t *testing.T) {
+	pkg := newTestChartPackage(t, newTestChart())
+	options := newTestProvenance(t, pkg)
+	defer os.RemoveAll(options.Dir)
+
+	verified, err := VerifyChartPackage(options, pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := provenance.DigestFile(filepath.Join(options.Dir, "test-0.1.0.tgz"))
+	if verified.SignedBy != "Test <test@openpitrix.io>" || verified.KeyId == "" || verified.Digest != "sha256:"+digest {
+		t.Errorf("unexpected provenance [%+v]", verified)
+	}
+
+	// the chart signed by a key not in the keyring
+	other := newTestProvenance(t, pkg)
+	defer os.RemoveAll(other.Dir)
+	_, err = VerifyChartPackage(&ProvenanceOptions{Keyring: options.Keyring, Dir: other.Dir}, pkg)
+	if err == nil {
+		t.Errorf("expected error for chart signed by unknown key")
+	}
+
+	// the chart changed after signed
+	c := newTestChart()
+	c.Metadata.Description = "changed"
+	_, err = VerifyChartPackage(options, newTestChartPackage(t, c))
+	if err == nil {
+		t.Errorf("expected error for chart changed after signed")
+	}
+
+	err = os.Remove(filepath.Join(other.Dir, "test-0.1.0.tgz.prov"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyChartPackage(other, pkg)
+	if err == nil {
+		t.Errorf("expected error for chart without provenance file")
+	}
+}
+
+func TestVerifyChartProvenance(t *testing.T) {
+	pkg := newTestChartPackage(t, newTestChart())
+	options := newTestProvenance(t, pkg)
+	defer os.RemoveAll(options.Dir)
+	defer SetProviderOptions(new(ProviderOptions))
+
+	SetProviderOptions(&ProviderOptions{
+		Runtimes: map[string]*RuntimeOptions{"runtime-signed": {Provenance: options}},
+	})
+
+	verified, err := verifyChartProvenance(context.Background(), "runtime-unsigned", pkg)
+	if err != nil || verified != nil {
+		t.Errorf("expected charts not verified by runtime without provenance policy")
+	}
+
+	verified, err = verifyChartProvenance(context.Background(), "runtime-signed", pkg)
+	if err != nil || verified == nil {
+		t.Errorf("expected chart verified by runtime with provenance policy, got error [%+v]", err)
+	}
+
+	c := newTestChart()
+	c.Metadata.Description = "changed"
+	_, err = verifyChartProvenance(context.Background(), "runtime-signed", newTestChartPackage(t, c))
+	if !gerr.IsGRPCError(err) {
+		t.Errorf("expected grpc error for chart not verified, got [%+v]", err)
+	}
+}
+
+func TestChartProvenanceAnnotation(t *testing.T) {
+	c := newTestChart()
+	if getChartProvenance(c) != nil {
+		t.Errorf("expected no provenance of chart not verified")
+	}
+
+	provenance := &ChartProvenance{SignedBy: "Test <test@openpitrix.io>", KeyId: "key", Digest: "sha256:digest"}
+	setChartProvenance(c, provenance)
+	if kept := getChartProvenance(c); kept == nil || *kept != *provenance {
+		t.Errorf("expected provenance [%+v] kept in chart, got [%+v]", provenance, kept)
+	}
+
+	setChartProvenance(c, nil)
+	if getChartProvenance(c) != nil {
+		t.Errorf("expected provenance removed from chart")
+	}
+}
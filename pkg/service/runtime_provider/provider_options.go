@@ -0,0 +1,229 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"openpitrix.io/openpitrix/pkg/logger"
+	"openpitrix.io/openpitrix/pkg/util/yamlutil"
+)
+
+const (
+	ProviderOptionsEnv         = "PROVIDER_OPTIONS"
+	DefaultProviderOptionsFile = "/etc/openpitrix/runtime-provider-helm3.yaml"
+)
+
+const (
+	ReleaseStorageSecrets    = "secrets"
+	ReleaseStorageConfigMaps = "configmaps"
+	ReleaseStorageMemory     = "memory"
+	ReleaseStorageSql        = "sql"
+)
+
+// ProviderOptions is the configuration of the provider, the options at top level apply to every runtime
+// and can be overridden per runtime id, e.g.
+//
+//	release_storage:
+//	  driver: secrets
+//	runtimes:
+//	  runtime-xxxxxxxx:
+//	    release_storage:
+//	      driver: sql
+//	      dsn: helm:password@tcp(openpitrix-db:3306)/helm
+//	chart_repositories:
+//	- name: stable
+//	  url: https://kubernetes-charts.storage.googleapis.com
+//	  index: /etc/openpitrix/charts/stable/index.yaml
+//	registries:
+//	- host: harbor.example.com
+//	  username: robot
+//	  password: password
+//	chart_references:
+//	- oci://harbor.example.com/library/
+//	provenance:
+//	  keyring: /etc/openpitrix/pubring.gpg
+//	  dir: /etc/openpitrix/provenance
+//	post_render:
+//	  kustomization: /etc/openpitrix/kustomize
+//	image_rewrite:
+//	  registries:
+//	    docker.io/: mirror.local/
+//	  pin_digest: true
+//	manifest_policy:
+//	  deny_privileged: true
+//	  deny_host_network: true
+//	  deny_host_path: true
+//	  require_limits: true
+//	  denied_service_types:
+//	  - LoadBalancer
+type ProviderOptions struct {
+	RuntimeOptions
+	Runtimes map[string]*RuntimeOptions `json:"runtimes,omitempty"`
+}
+
+type RuntimeOptions struct {
+	ReleaseStorage    *ReleaseStorageOptions    `json:"release_storage,omitempty"`
+	ChartRepositories []*ChartRepositoryOptions `json:"chart_repositories,omitempty"`
+	Registries        []*RegistryOptions        `json:"registries,omitempty"`
+	// ChartReferences are the OCI registries and repositories whose references are allowed in Conf instead of the app version package
+	ChartReferences []string               `json:"chart_references,omitempty"`
+	Provenance      *ProvenanceOptions     `json:"provenance,omitempty"`
+	PostRender      *PostRenderOptions     `json:"post_render,omitempty"`
+	ImageRewrite    *ImageRewriteOptions   `json:"image_rewrite,omitempty"`
+	ManifestPolicy  *ManifestPolicyOptions `json:"manifest_policy,omitempty"`
+}
+
+type ReleaseStorageOptions struct {
+	Driver string `json:"driver,omitempty"`
+	Dsn    string `json:"dsn,omitempty"`
+}
+
+// ChartRepositoryOptions is a chart repository resolving the chart dependencies referring to it,
+// by its url or by "@name", from the local copy of its index
+type ChartRepositoryOptions struct {
+	Name  string `json:"name,omitempty"`
+	Url   string `json:"url,omitempty"`
+	Index string `json:"index,omitempty"`
+}
+
+// RegistryOptions are the credentials of an OCI registry the charts are pulled from,
+// plain_http is required by the registries not serving https except localhost
+type RegistryOptions struct {
+	Host      string `json:"host,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	PlainHttp bool   `json:"plain_http,omitempty"`
+}
+
+// ProvenanceOptions is the policy requiring the charts signed by the keys in the keyring, the provenance file
+// of a chart package is kept in the dir, named after the package like "mysql-0.1.0.tgz.prov"
+type ProvenanceOptions struct {
+	Keyring string `json:"keyring,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+}
+
+// PostRenderOptions is the kustomization patching the manifests rendered from the charts, the dir holds
+// the kustomization.yaml and the patches it refers to, the rendered manifests are added to its resources
+type PostRenderOptions struct {
+	Kustomization string `json:"kustomization,omitempty"`
+}
+
+// ImageRewriteOptions is the policy rewriting the images of the containers to the registries reachable by the runtime,
+// the registries map the registries or repositories of the normalized images like "docker.io/" to their mirrors
+// like "mirror.local/", matching on a "/" boundary with or without the trailing "/",
+// pin_digest pins the images by the digests resolved from the registries they are rewritten to at install and upgrade,
+// the digests are kept in the manifests of the releases
+type ImageRewriteOptions struct {
+	Registries map[string]string `json:"registries,omitempty"`
+	PinDigest  bool              `json:"pin_digest,omitempty"`
+}
+
+// ManifestPolicyOptions are the rules the objects rendered from the charts are checked against before deploy,
+// require_limits requires the cpu and memory limits of every container
+type ManifestPolicyOptions struct {
+	DenyPrivileged     bool     `json:"deny_privileged,omitempty"`
+	DenyHostNetwork    bool     `json:"deny_host_network,omitempty"`
+	DenyHostPath       bool     `json:"deny_host_path,omitempty"`
+	RequireLimits      bool     `json:"require_limits,omitempty"`
+	DeniedServiceTypes []string `json:"denied_service_types,omitempty"`
+}
+
+var (
+	providerOptions     = new(ProviderOptions)
+	providerOptionsLock sync.RWMutex
+)
+
+func ParseProviderOptions(data []byte) (*ProviderOptions, error) {
+	options := new(ProviderOptions)
+	err := yamlutil.Decode(data, options)
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// LoadProviderOptions loads the provider options from the file in env PROVIDER_OPTIONS,
+// the provider runs with the default options when the file does not exist
+func LoadProviderOptions() error {
+	file := os.Getenv(ProviderOptionsEnv)
+	if file == "" {
+		file = DefaultProviderOptionsFile
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		logger.Info(nil, "Provider options [%s] not found, use default options", file)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	options, err := ParseProviderOptions(data)
+	if err != nil {
+		return err
+	}
+	SetProviderOptions(options)
+	return nil
+}
+
+func SetProviderOptions(options *ProviderOptions) {
+	providerOptionsLock.Lock()
+	defer providerOptionsLock.Unlock()
+	providerOptions = options
+}
+
+// GetRuntimeOptions returns the options of the runtime, every option not set for the runtime falls back to the top level one
+func GetRuntimeOptions(runtimeId string) RuntimeOptions {
+	providerOptionsLock.RLock()
+	defer providerOptionsLock.RUnlock()
+
+	options := providerOptions.RuntimeOptions
+	runtimeOptions, ok := providerOptions.Runtimes[runtimeId]
+	if !ok || runtimeOptions == nil {
+		return options
+	}
+
+	if runtimeOptions.ReleaseStorage != nil {
+		options.ReleaseStorage = runtimeOptions.ReleaseStorage
+	}
+	if runtimeOptions.ChartRepositories != nil {
+		options.ChartRepositories = runtimeOptions.ChartRepositories
+	}
+	if runtimeOptions.Registries != nil {
+		options.Registries = runtimeOptions.Registries
+	}
+	if runtimeOptions.ChartReferences != nil {
+		options.ChartReferences = runtimeOptions.ChartReferences
+	}
+	if runtimeOptions.Provenance != nil {
+		options.Provenance = runtimeOptions.Provenance
+	}
+	if runtimeOptions.PostRender != nil {
+		options.PostRender = runtimeOptions.PostRender
+	}
+	if runtimeOptions.ImageRewrite != nil {
+		options.ImageRewrite = runtimeOptions.ImageRewrite
+	}
+	if runtimeOptions.ManifestPolicy != nil {
+		options.ManifestPolicy = runtimeOptions.ManifestPolicy
+	}
+	return options
+}
+
+// GetReleaseStorage returns the release storage options, HELM_DRIVER is used when no driver is configured
+func (o RuntimeOptions) GetReleaseStorage() ReleaseStorageOptions {
+	var storage ReleaseStorageOptions
+	if o.ReleaseStorage != nil {
+		storage = *o.ReleaseStorage
+	}
+	if storage.Driver == "" {
+		storage.Driver = os.Getenv("HELM_DRIVER")
+	}
+	return storage
+}
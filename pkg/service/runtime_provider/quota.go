@@ -0,0 +1,395 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/models"
+	"openpitrix.io/openpitrix/pkg/util/jsonutil"
+)
+
+// workloadCountResources are the object count quotas of the workloads by kind
+var workloadCountResources = map[string]corev1.ResourceName{
+	"Deployment":  "count/deployments.apps",
+	"StatefulSet": "count/statefulsets.apps",
+	"DaemonSet":   "count/daemonsets.apps",
+}
+
+// objectCountResources are the object count quotas of the objects in the additional info of cluster
+var objectCountResources = map[string][]corev1.ResourceName{
+	"service":   {corev1.ResourceServices, "count/services"},
+	"configmap": {corev1.ResourceConfigMaps, "count/configmaps"},
+	"secret":    {corev1.ResourceSecrets, "count/secrets"},
+	"pvc":       {corev1.ResourcePersistentVolumeClaims, "count/persistentvolumeclaims"},
+}
+
+// ResourceShortfall is a resource limited by a resource quota of the namespace which is not enough for the cluster,
+// the available is the hard limit of the quota minus the used
+type ResourceShortfall struct {
+	Quota     string `json:"quota"`
+	Resource  string `json:"resource"`
+	Requested string `json:"requested"`
+	Available string `json:"available"`
+	Shortfall string `json:"shortfall"`
+}
+
+// getLimitRangeDefaults returns the default requests and the default limits of containers in the limit ranges,
+// the default limit is the default request as well when no default request is set, the same as the admission
+func getLimitRangeDefaults(limitRanges []corev1.LimitRange) (corev1.ResourceList, corev1.ResourceList) {
+	defaultRequests := corev1.ResourceList{}
+	defaultLimits := corev1.ResourceList{}
+	for _, limitRange := range limitRanges {
+		for _, item := range limitRange.Spec.Limits {
+			if item.Type != corev1.LimitTypeContainer {
+				continue
+			}
+			for name, quantity := range item.Default {
+				defaultLimits[name] = quantity
+				if _, ok := defaultRequests[name]; !ok {
+					defaultRequests[name] = quantity
+				}
+			}
+			for name, quantity := range item.DefaultRequest {
+				defaultRequests[name] = quantity
+			}
+		}
+	}
+	return defaultRequests, defaultLimits
+}
+
+func addResource(resources corev1.ResourceList, quantity resource.Quantity, replicas int64, names ...corev1.ResourceName) {
+	total := resource.NewMilliQuantity(quantity.MilliValue()*replicas, quantity.Format)
+	for _, name := range names {
+		sum := resources[name]
+		sum.Add(*total)
+		resources[name] = sum
+	}
+}
+
+// WorkloadResources are the resources requested by the pods of a workload decoded from the manifests,
+// kept in the additional info of cluster as the defaults of the limit ranges are known on check only
+type WorkloadResources struct {
+	Role           string                        `json:"role"`
+	Kind           string                        `json:"kind"`
+	Replicas       int64                         `json:"replicas"`
+	Containers     []corev1.ResourceRequirements `json:"containers"`
+	InitContainers []corev1.ResourceRequirements `json:"init_containers"`
+	// VolumeClaims are the claims created for every replica from the volume claim templates
+	VolumeClaims []VolumeClaimResources `json:"volume_claims"`
+}
+
+// VolumeClaimResources is the storage requested by a persistent volume claim in its storage class
+type VolumeClaimResources struct {
+	StorageClass string            `json:"storage_class"`
+	Storage      resource.Quantity `json:"storage"`
+}
+
+func getVolumeClaimResources(claim *corev1.PersistentVolumeClaim) VolumeClaimResources {
+	// the beta annotation takes precedence over the field, the same as the admission
+	storageClass, ok := claim.Annotations[corev1.BetaStorageClassAnnotation]
+	if !ok && claim.Spec.StorageClassName != nil {
+		storageClass = *claim.Spec.StorageClassName
+	}
+	return VolumeClaimResources{
+		StorageClass: storageClass,
+		Storage:      claim.Spec.Resources.Requests[corev1.ResourceStorage],
+	}
+}
+
+func getVolumeClaimInfo(claim *corev1.PersistentVolumeClaim) map[string]interface{} {
+	volumeClaim := getVolumeClaimResources(claim)
+	return map[string]interface{}{
+		"storage_class": volumeClaim.StorageClass,
+		"storage":       volumeClaim.Storage.String(),
+	}
+}
+
+// getWorkloadInfo returns the resources of the workload counted by the resource quotas, nil for the other objects
+func getWorkloadInfo(groupKind schema.GroupKind, obj runtime.Object) (map[string]interface{}, error) {
+	if _, ok := workloadCountResources[groupKind.Kind]; !ok {
+		return nil, nil
+	}
+	podSpecPath, ok := podSpecPaths[groupKind]
+	if !ok {
+		return nil, nil
+	}
+
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	name, _, _ := unstructured.NestedString(u, "metadata", "name")
+
+	// the daemon sets are counted as one replica, the same as their roles
+	replicas := int64(1)
+	if groupKind.Kind != "DaemonSet" {
+		if r, ok, _ := unstructured.NestedInt64(u, "spec", "replicas"); ok {
+			replicas = r
+		}
+	}
+
+	var podSpec corev1.PodSpec
+	podSpecObject, _, _ := unstructured.NestedMap(u, podSpecPath...)
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(podSpecObject, &podSpec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod spec of [%s/%s]: %+v", groupKind.Kind, name, err)
+	}
+
+	var containers, initContainers []corev1.ResourceRequirements
+	for _, container := range podSpec.Containers {
+		containers = append(containers, container.Resources)
+	}
+	for _, container := range podSpec.InitContainers {
+		initContainers = append(initContainers, container.Resources)
+	}
+
+	var volumeClaims []VolumeClaimResources
+	templates, _, _ := unstructured.NestedSlice(u, "spec", "volumeClaimTemplates")
+	for _, t := range templates {
+		template, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var claim corev1.PersistentVolumeClaim
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(template, &claim)
+		if err != nil {
+			return nil, fmt.Errorf("invalid volume claim template of [%s/%s]: %+v", groupKind.Kind, name, err)
+		}
+		volumeClaims = append(volumeClaims, getVolumeClaimResources(&claim))
+	}
+
+	return map[string]interface{}{
+		"role":            fmt.Sprintf("%s-%s", name, groupKind.Kind),
+		"kind":            groupKind.Kind,
+		"replicas":        replicas,
+		"containers":      containers,
+		"init_containers": initContainers,
+		"volume_claims":   volumeClaims,
+	}, nil
+}
+
+// getContainerResources returns the requests and the limits of the container as admitted,
+// the request is the limit when only the limit is set and the defaults of the limit ranges fill the others
+func getContainerResources(requirements corev1.ResourceRequirements, defaultRequests, defaultLimits corev1.ResourceList) (corev1.ResourceList, corev1.ResourceList) {
+	requests := corev1.ResourceList{}
+	limits := corev1.ResourceList{}
+	for name, quantity := range requirements.Limits {
+		limits[name] = quantity
+		requests[name] = quantity
+	}
+	for name, quantity := range requirements.Requests {
+		requests[name] = quantity
+	}
+	for name, quantity := range defaultLimits {
+		if _, ok := limits[name]; !ok {
+			limits[name] = quantity
+		}
+	}
+	for name, quantity := range defaultRequests {
+		if _, ok := requests[name]; !ok {
+			requests[name] = quantity
+		}
+	}
+	return requests, limits
+}
+
+// getPodResources returns the requests and the limits of a pod of the workload, the sum of the containers
+// or the most of the init containers which run one by one before them
+func getPodResources(workload *WorkloadResources, defaultRequests, defaultLimits corev1.ResourceList) (corev1.ResourceList, corev1.ResourceList) {
+	podRequests := corev1.ResourceList{}
+	podLimits := corev1.ResourceList{}
+	for _, requirements := range workload.Containers {
+		requests, limits := getContainerResources(requirements, defaultRequests, defaultLimits)
+		addResourceList(podRequests, requests)
+		addResourceList(podLimits, limits)
+	}
+	for _, requirements := range workload.InitContainers {
+		requests, limits := getContainerResources(requirements, defaultRequests, defaultLimits)
+		maxResourceList(podRequests, requests)
+		maxResourceList(podLimits, limits)
+	}
+	return podRequests, podLimits
+}
+
+func addResourceList(resources, added corev1.ResourceList) {
+	for name, quantity := range added {
+		addResource(resources, quantity, 1, name)
+	}
+}
+
+func maxResourceList(resources, other corev1.ResourceList) {
+	for name, quantity := range other {
+		if current, ok := resources[name]; !ok || quantity.Cmp(current) > 0 {
+			resources[name] = quantity
+		}
+	}
+}
+
+// addVolumeClaim adds the storage and the count of the claims to the quotas, and to the quotas of the storage class if any
+func addVolumeClaim(resources corev1.ResourceList, volumeClaim VolumeClaimResources, replicas int64, countClaims bool) {
+	names := []corev1.ResourceName{corev1.ResourceRequestsStorage}
+	if volumeClaim.StorageClass != "" {
+		names = append(names, corev1.ResourceName(volumeClaim.StorageClass+".storageclass.storage.k8s.io/"+string(corev1.ResourceRequestsStorage)))
+	}
+	addResource(resources, volumeClaim.Storage, replicas, names...)
+
+	names = nil
+	if countClaims {
+		names = append(names, objectCountResources["pvc"]...)
+	}
+	if volumeClaim.StorageClass != "" {
+		names = append(names, corev1.ResourceName(volumeClaim.StorageClass+".storageclass.storage.k8s.io/"+string(corev1.ResourcePersistentVolumeClaims)))
+	}
+	addResource(resources, *resource.NewQuantity(1, resource.DecimalSI), replicas, names...)
+}
+
+// getClusterResourceRequests returns the resources requested by the cluster in the names of the resource quotas,
+// from the workloads and the objects in the additional info of cluster parsed from the manifests.
+// The containers get the defaults of the limit ranges as they are admitted, the quotas of limits count only the limits set
+func getClusterResourceRequests(clusterWrapper *models.ClusterWrapper, limitRanges []corev1.LimitRange) (corev1.ResourceList, error) {
+	defaultRequests, defaultLimits := getLimitRangeDefaults(limitRanges)
+
+	requests := corev1.ResourceList{}
+	if clusterWrapper.Cluster == nil || clusterWrapper.Cluster.AdditionalInfo == "" {
+		return requests, nil
+	}
+
+	var additionalInfo map[string][]map[string]interface{}
+	err := jsonutil.Decode([]byte(clusterWrapper.Cluster.AdditionalInfo), &additionalInfo)
+	if err != nil {
+		return nil, err
+	}
+	for t, names := range objectCountResources {
+		addResource(requests, *resource.NewQuantity(int64(len(additionalInfo[t])), resource.DecimalSI), 1, names...)
+	}
+
+	var resources struct {
+		Workloads    []*WorkloadResources   `json:"workload"`
+		VolumeClaims []VolumeClaimResources `json:"pvc"`
+	}
+	err = jsonutil.Decode([]byte(clusterWrapper.Cluster.AdditionalInfo), &resources)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, workload := range resources.Workloads {
+		replicas := workload.Replicas
+
+		podRequests, podLimits := getPodResources(workload, defaultRequests, defaultLimits)
+		for name, quantity := range podRequests {
+			names := []corev1.ResourceName{corev1.ResourceName("requests." + name)}
+			if name == corev1.ResourceCPU || name == corev1.ResourceMemory || name == corev1.ResourceEphemeralStorage {
+				names = append(names, name)
+			}
+			addResource(requests, quantity, replicas, names...)
+		}
+		for name, quantity := range podLimits {
+			addResource(requests, quantity, replicas, corev1.ResourceName("limits."+name))
+		}
+
+		// the claims of the volume claim templates are not in the additional info of cluster
+		for _, volumeClaim := range workload.VolumeClaims {
+			addVolumeClaim(requests, volumeClaim, replicas, true)
+		}
+
+		addResource(requests, *resource.NewQuantity(1, resource.DecimalSI), replicas, corev1.ResourcePods, "count/pods")
+		if name, ok := workloadCountResources[workload.Kind]; ok {
+			addResource(requests, *resource.NewQuantity(1, resource.DecimalSI), 1, name)
+		}
+	}
+
+	for _, volumeClaim := range resources.VolumeClaims {
+		addVolumeClaim(requests, volumeClaim, 1, false)
+	}
+	return requests, nil
+}
+
+// getResourceShortfalls compares the requests with the resource quotas, the quotas with scopes are skipped
+// as the scopes of the pods of the cluster are unknown before they are created
+func getResourceShortfalls(quotas []corev1.ResourceQuota, requests corev1.ResourceList) []ResourceShortfall {
+	var shortfalls []ResourceShortfall
+	for _, quota := range quotas {
+		if len(quota.Spec.Scopes) > 0 || quota.Spec.ScopeSelector != nil {
+			continue
+		}
+
+		hard := quota.Status.Hard
+		if hard == nil {
+			hard = quota.Spec.Hard
+		}
+		for name, limit := range hard {
+			requested, ok := requests[name]
+			if !ok || requested.IsZero() {
+				continue
+			}
+
+			available := limit.DeepCopy()
+			available.Sub(quota.Status.Used[name])
+			if requested.Cmp(available) <= 0 {
+				continue
+			}
+			shortfall := requested.DeepCopy()
+			shortfall.Sub(available)
+			shortfalls = append(shortfalls, ResourceShortfall{
+				Quota:     quota.Name,
+				Resource:  string(name),
+				Requested: requested.String(),
+				Available: available.String(),
+				Shortfall: shortfall.String(),
+			})
+		}
+	}
+
+	sort.Slice(shortfalls, func(i, j int) bool {
+		if shortfalls[i].Quota != shortfalls[j].Quota {
+			return shortfalls[i].Quota < shortfalls[j].Quota
+		}
+		return shortfalls[i].Resource < shortfalls[j].Resource
+	})
+	return shortfalls
+}
+
+// CheckResourceQuota checks the cluster fits in the resource quotas of the namespace,
+// the shortfalls are reported in the error when it does not
+func (p *KubeHandler) CheckResourceQuota(namespace string, clusterWrapper *models.ClusterWrapper) error {
+	kubeClient, _, err := p.initKubeClient()
+	if err != nil {
+		return err
+	}
+
+	quotas, err := kubeClient.CoreV1().ResourceQuotas(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	if len(quotas.Items) == 0 {
+		return nil
+	}
+
+	limitRanges, err := kubeClient.CoreV1().LimitRanges(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	requests, err := getClusterResourceRequests(clusterWrapper, limitRanges.Items)
+	if err != nil {
+		return err
+	}
+
+	shortfalls := getResourceShortfalls(quotas.Items, requests)
+	if len(shortfalls) > 0 {
+		return gerr.New(p.ctx, gerr.ResourceExhausted, gerr.ErrorResourceQuotaNotEnough, jsonutil.ToString(shortfalls))
+	}
+	return nil
+}
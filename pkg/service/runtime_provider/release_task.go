@@ -0,0 +1,117 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"openpitrix.io/openpitrix/pkg/logger"
+	"openpitrix.io/openpitrix/pkg/util/ctxutil"
+)
+
+// DefaultReleaseTaskExpiration is how long the outcome of a finished release task is kept for WaitSubtask
+const DefaultReleaseTaskExpiration = 2 * time.Hour
+
+var releaseTasks = NewReleaseTaskTracker(DefaultReleaseTaskExpiration)
+
+type ReleaseTaskState struct {
+	Done bool
+	Err  error
+}
+
+type releaseTask struct {
+	state      ReleaseTaskState
+	finishTime time.Time
+}
+
+// ReleaseTaskTracker runs the helm actions started by HandleSubtask in background and records
+// their outcome, so that WaitSubtask can report why a release failed or was reverted
+type ReleaseTaskTracker struct {
+	lock       sync.Mutex
+	expiration time.Duration
+	tasks      map[string]*releaseTask
+}
+
+func NewReleaseTaskTracker(expiration time.Duration) *ReleaseTaskTracker {
+	return &ReleaseTaskTracker{
+		expiration: expiration,
+		tasks:      make(map[string]*releaseTask),
+	}
+}
+
+// detachContext keeps the message id and sender of ctx without its deadline and cancellation
+func detachContext(ctx context.Context) context.Context {
+	detached := ctxutil.Copy(ctx, context.Background())
+	if s := ctxutil.GetSender(ctx); s != nil {
+		detached = ctxutil.ContextWithSender(detached, s)
+	}
+	return detached
+}
+
+// Start runs f for the task unless the task is already running
+func (t *ReleaseTaskTracker) Start(taskId string, f func() error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.evictExpired(time.Now())
+
+	if task, ok := t.tasks[taskId]; ok && !task.state.Done {
+		return
+	}
+	t.tasks[taskId] = new(releaseTask)
+
+	go func() {
+		err := runTask(taskId, f)
+
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		t.tasks[taskId] = &releaseTask{
+			state:      ReleaseTaskState{Done: true, Err: err},
+			finishTime: time.Now(),
+		}
+	}()
+}
+
+// runTask returns the panic of f as its error, so that a helm action panicking fails the task only
+func runTask(taskId string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(nil, "Release task [%s] panicked: %v\n%s", taskId, r, debug.Stack())
+			err = fmt.Errorf("release task panicked: %v", r)
+		}
+	}()
+	return f()
+}
+
+// Get returns the state of the task, false if the task is not started by this provider
+func (t *ReleaseTaskTracker) Get(taskId string) (ReleaseTaskState, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	task, ok := t.tasks[taskId]
+	if !ok {
+		return ReleaseTaskState{}, false
+	}
+	return task.state, true
+}
+
+func (t *ReleaseTaskTracker) Remove(taskId string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.tasks, taskId)
+}
+
+func (t *ReleaseTaskTracker) evictExpired(now time.Time) {
+	for taskId, task := range t.tasks {
+		if task.state.Done && now.Sub(task.finishTime) > t.expiration {
+			delete(t.tasks, taskId)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"fmt"
+	"strings"
+
+	"helm.sh/helm/pkg/chart"
+	"sigs.k8s.io/yaml"
+
+	"openpitrix.io/openpitrix/pkg/models"
+)
+
+const (
+	// RoleValuesAnnotationKey is the annotation in Chart.yaml mapping the cluster roles to the values controlling them
+	RoleValuesAnnotationKey = "openpitrix.io/role-values"
+	// RoleValuesKey is the key in values.yaml of the mapping, used when the annotation is absent
+	RoleValuesKey = "openpitrixRoleValues"
+)
+
+// RoleValues are the dotted paths of the values controlling the replicas and the resources of a cluster role,
+// the cpu is set in cores and the memory in Gi, as they are parsed into the cluster role
+type RoleValues struct {
+	Replicas string `json:"replicas,omitempty"`
+	Cpu      string `json:"cpu,omitempty"`
+	Memory   string `json:"memory,omitempty"`
+}
+
+// getRoleValues returns the role values mapping declared by the chart, keyed by the role, such as
+// "mysql-Deployment", with or without the prefix of the release name
+func getRoleValues(c *chart.Chart) (map[string]*RoleValues, error) {
+	var data []byte
+	if annotation, ok := c.Metadata.Annotations[RoleValuesAnnotationKey]; ok {
+		data = []byte(annotation)
+	} else if v, ok := c.Values[RoleValuesKey]; ok {
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	} else {
+		return nil, fmt.Errorf("chart [%s] declares no values of cluster roles in annotation [%s] or values [%s]",
+			c.Name(), RoleValuesAnnotationKey, RoleValuesKey)
+	}
+
+	roleValues := make(map[string]*RoleValues)
+	err := yaml.Unmarshal(data, &roleValues)
+	if err != nil {
+		return nil, fmt.Errorf("values of cluster roles in chart [%s] are invalid: %+v", c.Name(), err)
+	}
+	return roleValues, nil
+}
+
+func findRoleValues(roleValues map[string]*RoleValues, releaseName, role string) *RoleValues {
+	if v, ok := roleValues[role]; ok {
+		return v
+	}
+	return roleValues[strings.TrimPrefix(role, releaseName+"-")]
+}
+
+// setValuesPath sets v at the dotted path of vals, creating the missing tables
+func setValuesPath(vals map[string]interface{}, path string, v interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := vals[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			vals[key] = next
+		}
+		vals = next
+	}
+	vals[keys[len(keys)-1]] = v
+}
+
+// getRoleOverrides returns the values applying the replicas of the cluster roles, and their cpu and memory when
+// resources is true, the roles and fields without values mapped are left as they are
+func getRoleOverrides(roleValues map[string]*RoleValues, releaseName string, clusterRoles map[string]*models.ClusterRole, resources bool) (map[string]interface{}, error) {
+	overrides := make(map[string]interface{})
+	for _, clusterRole := range clusterRoles {
+		v := findRoleValues(roleValues, releaseName, clusterRole.Role)
+		if v == nil {
+			continue
+		}
+
+		// daemonsets run on every node, their replicas cannot be set
+		if v.Replicas != "" && !strings.HasSuffix(clusterRole.Role, DaemonSetFlag) {
+			setValuesPath(overrides, v.Replicas, clusterRole.Replicas)
+		}
+
+		if !resources {
+			continue
+		}
+		if v.Cpu != "" && clusterRole.Cpu > 0 {
+			setValuesPath(overrides, v.Cpu, fmt.Sprintf("%d", clusterRole.Cpu))
+		}
+		if v.Memory != "" && clusterRole.Memory > 0 {
+			setValuesPath(overrides, v.Memory, fmt.Sprintf("%dGi", clusterRole.Memory))
+		}
+	}
+
+	if len(overrides) == 0 {
+		return nil, fmt.Errorf("no values of the cluster roles to change are declared")
+	}
+	return overrides, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/xeipuuv/gojsonschema"
+	"helm.sh/helm/pkg/chart"
+	"helm.sh/helm/pkg/chartutil"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+)
+
+// SchemaViolation is a value violating the values.schema.json of the chart or of a subchart,
+// the path of the value is a json path from the values of the chart, e.g. "$.mysql.image.tag"
+type SchemaViolation struct {
+	Path    string
+	Message string
+}
+
+func (v SchemaViolation) String() string {
+	return fmt.Sprintf("%s: %s", v.Path, v.Message)
+}
+
+// ValidateValuesSchema validates the coalesced values against the schemas of the chart and its subcharts,
+// and returns all the violations rather than the first one
+func ValidateValuesSchema(c *chart.Chart, vals map[string]interface{}) ([]SchemaViolation, error) {
+	return validateValuesSchema(c, vals, "$")
+}
+
+func validateValuesSchema(c *chart.Chart, vals map[string]interface{}, path string) ([]SchemaViolation, error) {
+	if vals == nil {
+		vals = make(map[string]interface{})
+	}
+
+	var violations []SchemaViolation
+	if len(c.Schema) > 0 {
+		result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(c.Schema), gojsonschema.NewGoLoader(vals))
+		if err != nil {
+			return nil, fmt.Errorf("values.schema.json of chart [%s] is invalid: %+v", c.Name(), err)
+		}
+		for _, resultErr := range result.Errors() {
+			field := path
+			if resultErr.Field() != gojsonschema.STRING_ROOT_SCHEMA_PROPERTY {
+				field += "." + resultErr.Field()
+			}
+			violations = append(violations, SchemaViolation{Path: field, Message: resultErr.Description()})
+		}
+	}
+
+	// the values of a subchart are under its name, which is the alias if any once the dependencies are processed
+	for _, subchart := range c.Dependencies() {
+		var subVals map[string]interface{}
+		switch v := vals[subchart.Name()].(type) {
+		case map[string]interface{}:
+			subVals = v
+		case chartutil.Values:
+			subVals = v
+		}
+
+		subViolations, err := validateValuesSchema(subchart, subVals, path+"."+subchart.Name())
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, subViolations...)
+	}
+	return violations, nil
+}
+
+// newSchemaError reports all the violations in one error with a detail for every violation
+func newSchemaError(ctx context.Context, violations []SchemaViolation) error {
+	var causes []string
+	for _, violation := range violations {
+		causes = append(causes, violation.String())
+	}
+	return newDetailedError(ctx, gerr.InvalidArgument, gerr.ErrorValidateFailed, causes)
+}
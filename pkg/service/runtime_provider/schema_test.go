@@ -0,0 +1,124 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/status"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/models"
+	"openpitrix.io/openpitrix/pkg/pb"
+)
+
+const testValuesSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "properties": {
+    "image": {
+      "type": "object",
+      "properties": {
+        "tag": {"type": "string"}
+      }
+    },
+    "replicas": {"type": "integer", "minimum": 1}
+  }
+}`
+
+const testSubchartValuesSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "required": ["password"],
+  "properties": {
+    "password": {"type": "string"}
+  }
+}`
+
+func TestValidateValuesSchema(t *testing.T) {
+	c := newTestChart()
+	c.Schema = []byte(testValuesSchema)
+	subchart := newTestSubchart("redis", "0.1.0")
+	subchart.Schema = []byte(testSubchartValuesSchema)
+	c.AddDependency(subchart)
+
+	violations, err := ValidateValuesSchema(c, map[string]interface{}{
+		"image":    map[string]interface{}{"tag": "5.7"},
+		"replicas": 1,
+		"redis":    map[string]interface{}{"password": "password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) > 0 {
+		t.Errorf("expected no violation, got [%+v]", violations)
+	}
+
+	violations, err = ValidateValuesSchema(c, map[string]interface{}{
+		"image":    map[string]interface{}{"tag": 5.7},
+		"replicas": 0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, violation := range violations {
+		paths = append(paths, violation.Path)
+	}
+	sort.Strings(paths)
+	if strings.Join(paths, ",") != "$.image.tag,$.redis,$.replicas" {
+		t.Errorf("expected all violations of the chart and the subchart, got [%+v]", violations)
+	}
+
+	err = newSchemaError(context.Background(), violations)
+	if !gerr.IsGRPCError(err) {
+		t.Errorf("expected grpc error, got [%+v]", err)
+	}
+	for _, path := range paths {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("expected violation of [%s] in error [%s]", path, err.Error())
+		}
+	}
+
+	c.Schema = []byte("{")
+	_, err = ValidateValuesSchema(c, nil)
+	if err == nil {
+		t.Errorf("expected error for invalid schema")
+	}
+}
+
+func TestParseWithValuesSchema(t *testing.T) {
+	c := newTestChart()
+	c.Schema = []byte(testValuesSchema)
+
+	// the schema is validated before the lint and the rendering, which need no runtime
+	parser := Parser{
+		ctx:       context.Background(),
+		Chart:     c,
+		Conf:      "Name: test\nValuesPolicy: reset\nreplicas: 0\nimage:\n  tag: 5.7\n",
+		RuntimeId: "runtime-test",
+		Namespace: "default",
+	}
+	err := parser.Parse(new(models.ClusterWrapper), "app-test")
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != gerr.InvalidArgument {
+		t.Fatalf("expected grpc error with code [%s], got [%+v]", gerr.InvalidArgument, err)
+	}
+
+	// the first detail is the error of all the violations
+	var paths []string
+	for _, detail := range s.Details()[1:] {
+		if d, ok := detail.(*pb.ErrorDetail); ok {
+			paths = append(paths, strings.SplitN(d.Cause, ":", 2)[0])
+		}
+	}
+	sort.Strings(paths)
+	if strings.Join(paths, ",") != "$.image.tag,$.replicas" {
+		t.Errorf("expected a detail for every violation, got [%+v]", paths)
+	}
+}
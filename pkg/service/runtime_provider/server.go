@@ -23,7 +23,11 @@ type Server struct {
 
 func Serve(cfg *config.Config) {
 	pi.SetGlobal(cfg)
-	err := providerclient.RegisterRuntimeProvider(Provider, ProviderConfig)
+	err := LoadProviderOptions()
+	if err != nil {
+		logger.Critical(nil, "failed to load provider options: %+v", err)
+	}
+	err = providerclient.RegisterRuntimeProvider(Provider, ProviderConfig)
 	if err != nil {
 		logger.Critical(nil, "failed to register provider config: %+v", err)
 	}
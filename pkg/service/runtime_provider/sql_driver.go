@@ -0,0 +1,306 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"helm.sh/helm/pkg/release"
+	"helm.sh/helm/pkg/storage/driver"
+)
+
+const SqlDriverName = "SQL"
+
+// mysql error number of duplicate entry for key
+const mysqlErrDupEntry = 1062
+
+const (
+	sqlCreateTable = "CREATE TABLE IF NOT EXISTS helm_release (" +
+		"runtime_id VARCHAR(50) NOT NULL, " +
+		"namespace VARCHAR(255) NOT NULL, " +
+		"release_key VARCHAR(255) NOT NULL, " +
+		"name VARCHAR(255) NOT NULL, " +
+		"version INT NOT NULL, " +
+		"status VARCHAR(50) NOT NULL, " +
+		"owner VARCHAR(50) NOT NULL, " +
+		"body LONGTEXT NOT NULL, " +
+		"create_time BIGINT NOT NULL, " +
+		"status_time BIGINT NOT NULL, " +
+		"PRIMARY KEY (runtime_id, namespace, release_key))"
+	sqlSelectBody = "SELECT body FROM helm_release WHERE runtime_id = ? AND namespace = ?"
+	sqlInsert     = "INSERT INTO helm_release " +
+		"(runtime_id, namespace, release_key, name, version, status, owner, body, create_time, status_time) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	sqlUpdate = "UPDATE helm_release SET version = ?, status = ?, body = ?, status_time = ? " +
+		"WHERE runtime_id = ? AND namespace = ? AND release_key = ?"
+	sqlDelete = "DELETE FROM helm_release WHERE runtime_id = ? AND namespace = ? AND release_key = ?"
+)
+
+// sqlQueryColumns maps the labels queried by helm storage to the columns of helm_release
+var sqlQueryColumns = map[string]string{
+	"name":    "name",
+	"version": "version",
+	"status":  "status",
+	"owner":   "owner",
+}
+
+var (
+	sqlDatabases     = make(map[string]*sql.DB)
+	sqlDatabasesLock sync.Mutex
+)
+
+var _ driver.Driver = (*SqlDriver)(nil)
+
+// SqlDriver stores the releases of a runtime namespace in a mysql table, so that
+// the history of the releases survives the namespace being deleted
+type SqlDriver struct {
+	db        *sql.DB
+	runtimeId string
+	namespace string
+	Log       func(string, ...interface{})
+}
+
+// openSqlDatabase returns the database shared by all runtimes using dsn
+func openSqlDatabase(dsn string) (*sql.DB, error) {
+	sqlDatabasesLock.Lock()
+	defer sqlDatabasesLock.Unlock()
+
+	if db, ok := sqlDatabases[dsn]; ok {
+		return db, nil
+	}
+
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// affected rows of an update must count the matched rows, see SqlDriver.Update
+	cfg.ClientFoundRows = true
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(sqlCreateTable)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	sqlDatabases[dsn] = db
+	return db, nil
+}
+
+func NewSqlDriver(db *sql.DB, runtimeId, namespace string) *SqlDriver {
+	return &SqlDriver{
+		db:        db,
+		runtimeId: runtimeId,
+		namespace: namespace,
+		Log:       func(_ string, _ ...interface{}) {},
+	}
+}
+
+func (s *SqlDriver) Name() string {
+	return SqlDriverName
+}
+
+func (s *SqlDriver) Get(key string) (*release.Release, error) {
+	rlss, err := s.query(sqlSelectBody+" AND release_key = ?", s.runtimeId, s.namespace, key)
+	if err != nil {
+		s.Log("get: failed to get %q: %s", key, err)
+		return nil, err
+	}
+	if len(rlss) == 0 {
+		return nil, driver.ErrReleaseNotFound
+	}
+	return rlss[0], nil
+}
+
+func (s *SqlDriver) List(filter func(*release.Release) bool) ([]*release.Release, error) {
+	rlss, err := s.query(sqlSelectBody, s.runtimeId, s.namespace)
+	if err != nil {
+		s.Log("list: failed to list: %s", err)
+		return nil, err
+	}
+
+	var results []*release.Release
+	for _, rls := range rlss {
+		if filter(rls) {
+			results = append(results, rls)
+		}
+	}
+	return results, nil
+}
+
+func (s *SqlDriver) Query(labels map[string]string) ([]*release.Release, error) {
+	var keys []string
+	for k := range labels {
+		if _, ok := sqlQueryColumns[k]; !ok {
+			return nil, fmt.Errorf("query: label [%s] is not supported", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	query := sqlSelectBody
+	args := []interface{}{s.runtimeId, s.namespace}
+	for _, k := range keys {
+		query += fmt.Sprintf(" AND %s = ?", sqlQueryColumns[k])
+		args = append(args, labels[k])
+	}
+
+	rlss, err := s.query(query, args...)
+	if err != nil {
+		s.Log("query: failed to query with labels: %s", err)
+		return nil, err
+	}
+	if len(rlss) == 0 {
+		return nil, driver.ErrReleaseNotFound
+	}
+	return rlss, nil
+}
+
+func (s *SqlDriver) Create(key string, rls *release.Release) error {
+	body, err := encodeSqlRelease(rls)
+	if err != nil {
+		s.Log("create: failed to encode release %q: %s", rls.Name, err)
+		return err
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(sqlInsert, s.runtimeId, s.namespace, key,
+		rls.Name, rls.Version, getSqlReleaseStatus(rls), "helm", body, now, now)
+	if err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlErrDupEntry {
+			return driver.ErrReleaseExists
+		}
+		s.Log("create: failed to create: %s", err)
+		return err
+	}
+	return nil
+}
+
+func (s *SqlDriver) Update(key string, rls *release.Release) error {
+	body, err := encodeSqlRelease(rls)
+	if err != nil {
+		s.Log("update: failed to encode release %q: %s", rls.Name, err)
+		return err
+	}
+
+	result, err := s.db.Exec(sqlUpdate, rls.Version, getSqlReleaseStatus(rls), body, time.Now().Unix(),
+		s.runtimeId, s.namespace, key)
+	if err != nil {
+		s.Log("update: failed to update: %s", err)
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return driver.ErrReleaseNotFound
+	}
+	return nil
+}
+
+func (s *SqlDriver) Delete(key string) (*release.Release, error) {
+	rls, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(sqlDelete, s.runtimeId, s.namespace, key)
+	if err != nil {
+		s.Log("delete: failed to delete %q: %s", key, err)
+		return nil, err
+	}
+	return rls, nil
+}
+
+func (s *SqlDriver) query(query string, args ...interface{}) ([]*release.Release, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*release.Release
+	for rows.Next() {
+		var body string
+		err = rows.Scan(&body)
+		if err != nil {
+			return nil, err
+		}
+
+		rls, err := decodeSqlRelease(body)
+		if err != nil {
+			s.Log("query: failed to decode release: %s", err)
+			continue
+		}
+		results = append(results, rls)
+	}
+	return results, rows.Err()
+}
+
+func getSqlReleaseStatus(rls *release.Release) string {
+	if rls.Info == nil {
+		return ""
+	}
+	return rls.Info.Status.String()
+}
+
+// encodeSqlRelease encodes the release the same way as the secrets and configmaps drivers of helm
+func encodeSqlRelease(rls *release.Release) (string, error) {
+	b, err := json.Marshal(rls)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(b); err != nil {
+		return "", err
+	}
+	w.Close()
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeSqlRelease(data string) (*release.Release, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	b, err = ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var rls release.Release
+	err = json.Unmarshal(b, &rls)
+	if err != nil {
+		return nil, err
+	}
+	return &rls, nil
+}
@@ -0,0 +1,292 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"helm.sh/helm/pkg/action"
+	"helm.sh/helm/pkg/release"
+	"helm.sh/helm/pkg/storage"
+	"helm.sh/helm/pkg/storage/driver"
+)
+
+// fakeSqlDriver is a database/sql driver understanding the statements of SqlDriver,
+// it keeps the rows of helm_release of every database name in memory and behaves like mysql on duplicate keys
+type fakeSqlDriver struct {
+	lock      sync.Mutex
+	databases map[string]*fakeSql
+}
+
+type fakeSql struct {
+	lock sync.Mutex
+	rows []map[string]interface{}
+}
+
+type fakeSqlConn struct{ db *fakeSql }
+
+type fakeSqlStmt struct {
+	db    *fakeSql
+	query string
+}
+
+type fakeSqlRows struct{ bodies []string }
+
+func init() {
+	sql.Register("fakesql", &fakeSqlDriver{databases: make(map[string]*fakeSql)})
+}
+
+func (f *fakeSqlDriver) Open(name string) (sqldriver.Conn, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	db, ok := f.databases[name]
+	if !ok {
+		db = new(fakeSql)
+		f.databases[name] = db
+	}
+	return &fakeSqlConn{db: db}, nil
+}
+
+func (c *fakeSqlConn) Prepare(query string) (sqldriver.Stmt, error) {
+	return &fakeSqlStmt{db: c.db, query: query}, nil
+}
+func (c *fakeSqlConn) Close() error                 { return nil }
+func (c *fakeSqlConn) Begin() (sqldriver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+func (s *fakeSqlStmt) Close() error  { return nil }
+func (s *fakeSqlStmt) NumInput() int { return -1 }
+
+// columns returns the columns of "a = ?, b = ?" or "a = ? AND b = ?"
+func fakeSqlColumns(s, sep string) []string {
+	var columns []string
+	for _, c := range strings.Split(s, sep) {
+		columns = append(columns, strings.TrimSuffix(strings.TrimSpace(c), " = ?"))
+	}
+	return columns
+}
+
+func (s *fakeSqlStmt) match(row map[string]interface{}, columns []string, args []sqldriver.Value) bool {
+	for i, c := range columns {
+		if fmt.Sprint(row[c]) != fmt.Sprint(args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *fakeSqlStmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+
+	switch {
+	case s.query == sqlCreateTable:
+		return sqldriver.RowsAffected(0), nil
+	case s.query == sqlInsert:
+		columns := fakeSqlColumns(s.query[strings.Index(s.query, "(")+1:strings.Index(s.query, ")")], ",")
+		row := make(map[string]interface{})
+		for i, c := range columns {
+			row[c] = args[i]
+		}
+		for _, r := range s.db.rows {
+			if s.match(r, []string{"runtime_id", "namespace", "release_key"}, args[:3]) {
+				return nil, &mysql.MySQLError{Number: mysqlErrDupEntry, Message: "Duplicate entry"}
+			}
+		}
+		s.db.rows = append(s.db.rows, row)
+		return sqldriver.RowsAffected(1), nil
+	case s.query == sqlUpdate:
+		set := s.query[strings.Index(s.query, " SET ")+5 : strings.Index(s.query, " WHERE ")]
+		setColumns := fakeSqlColumns(set, ",")
+		whereColumns := fakeSqlColumns(s.query[strings.Index(s.query, " WHERE ")+7:], " AND ")
+		var count int64
+		for _, r := range s.db.rows {
+			if s.match(r, whereColumns, args[len(setColumns):]) {
+				for i, c := range setColumns {
+					r[c] = args[i]
+				}
+				count++
+			}
+		}
+		return sqldriver.RowsAffected(count), nil
+	case s.query == sqlDelete:
+		whereColumns := fakeSqlColumns(s.query[strings.Index(s.query, " WHERE ")+7:], " AND ")
+		var rows []map[string]interface{}
+		for _, r := range s.db.rows {
+			if !s.match(r, whereColumns, args) {
+				rows = append(rows, r)
+			}
+		}
+		count := int64(len(s.db.rows) - len(rows))
+		s.db.rows = rows
+		return sqldriver.RowsAffected(count), nil
+	}
+	return nil, fmt.Errorf("unexpected statement [%s]", s.query)
+}
+
+func (s *fakeSqlStmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+
+	if !strings.HasPrefix(s.query, sqlSelectBody) {
+		return nil, fmt.Errorf("unexpected query [%s]", s.query)
+	}
+	whereColumns := fakeSqlColumns(s.query[strings.Index(s.query, " WHERE ")+7:], " AND ")
+	rows := new(fakeSqlRows)
+	for _, r := range s.db.rows {
+		if s.match(r, whereColumns, args) {
+			rows.bodies = append(rows.bodies, r["body"].(string))
+		}
+	}
+	return rows, nil
+}
+
+func (r *fakeSqlRows) Columns() []string { return []string{"body"} }
+func (r *fakeSqlRows) Close() error      { return nil }
+func (r *fakeSqlRows) Next(dest []sqldriver.Value) error {
+	if len(r.bodies) == 0 {
+		return io.EOF
+	}
+	dest[0], r.bodies = r.bodies[0], r.bodies[1:]
+	return nil
+}
+
+func newTestSqlDatabase(t *testing.T) *sql.DB {
+	db, err := sql.Open("fakesql", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestSqlRelease(name string, version int, status release.Status) *release.Release {
+	return &release.Release{
+		Name:      name,
+		Version:   version,
+		Namespace: "test-zone",
+		Info:      &release.Info{Status: status},
+	}
+}
+
+func TestSqlDriver(t *testing.T) {
+	db := newTestSqlDatabase(t)
+	d := NewSqlDriver(db, "runtime-test", "test-zone")
+
+	v1 := newTestSqlRelease("test", 1, release.StatusDeployed)
+	err := d.Create("sh.helm.release.v1.test.v1", v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Create("sh.helm.release.v1.test.v1", v1)
+	if err != driver.ErrReleaseExists {
+		t.Errorf("expected error [%s], got [%+v]", driver.ErrReleaseExists, err)
+	}
+
+	v1.Info.Status = release.StatusSuperseded
+	err = d.Update("sh.helm.release.v1.test.v1", v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Update("sh.helm.release.v1.test.v9", v1)
+	if err != driver.ErrReleaseNotFound {
+		t.Errorf("expected error [%s], got [%+v]", driver.ErrReleaseNotFound, err)
+	}
+
+	err = d.Create("sh.helm.release.v1.test.v2", newTestSqlRelease("test", 2, release.StatusDeployed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rls, err := d.Get("sh.helm.release.v1.test.v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rls.Name != "test" || rls.Version != 1 || rls.Info.Status != release.StatusSuperseded {
+		t.Errorf("unexpected release [%+v]", rls)
+	}
+
+	rlss, err := d.Query(map[string]string{"name": "test", "owner": "helm", "status": "deployed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rlss) != 1 || rlss[0].Version != 2 {
+		t.Errorf("expected deployed release of version [2], got [%+v]", rlss)
+	}
+
+	rlss, err = d.List(func(*release.Release) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rlss) != 2 {
+		t.Errorf("expected [2] releases, got [%d]", len(rlss))
+	}
+
+	// releases of other runtimes in the same namespace stay apart
+	_, err = NewSqlDriver(db, "runtime-other", "test-zone").Get("sh.helm.release.v1.test.v1")
+	if err != driver.ErrReleaseNotFound {
+		t.Errorf("expected error [%s], got [%+v]", driver.ErrReleaseNotFound, err)
+	}
+
+	rls, err = d.Delete("sh.helm.release.v1.test.v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rls.Version != 1 {
+		t.Errorf("expected deleted release of version [1], got [%d]", rls.Version)
+	}
+	_, err = d.Get("sh.helm.release.v1.test.v1")
+	if err != driver.ErrReleaseNotFound {
+		t.Errorf("expected error [%s], got [%+v]", driver.ErrReleaseNotFound, err)
+	}
+}
+
+func TestSqlDriverKeepsHistory(t *testing.T) {
+	db := newTestSqlDatabase(t)
+
+	cfg := newTestActionConfig()
+	cfg.Releases = storage.Init(NewSqlDriver(db, "runtime-test", "test-zone"))
+
+	installClient := action.NewInstall(cfg)
+	installClient.ReleaseName = "test"
+	installClient.Namespace = "test-zone"
+	_, err := installClient.Run(newTestChart(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgradeClient := action.NewUpgrade(cfg)
+	upgradeClient.Namespace = "test-zone"
+	_, err = upgradeClient.Run("test", newTestChart(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new action configuration on the same database, as after the namespace being wiped
+	cfg = newTestActionConfig()
+	cfg.Releases = storage.Init(NewSqlDriver(db, "runtime-test", "test-zone"))
+
+	history, err := action.NewHistory(cfg).Run("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected [2] revisions, got [%d]", len(history))
+	}
+	for _, rls := range history {
+		if rls.Version == 1 && rls.Info.Status != release.StatusSuperseded {
+			t.Errorf("expected revision [1] to be superseded, got [%s]", rls.Info.Status)
+		}
+		if rls.Version == 2 && rls.Info.Status != release.StatusDeployed {
+			t.Errorf("expected revision [2] to be deployed, got [%s]", rls.Info.Status)
+		}
+	}
+}
@@ -6,8 +6,17 @@ package runtime_provider
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
+	"google.golang.org/grpc/codes"
+
+	"openpitrix.io/openpitrix/pkg/gerr"
+	"openpitrix.io/openpitrix/pkg/logger"
+	"openpitrix.io/openpitrix/pkg/pb"
 	"openpitrix.io/openpitrix/pkg/util/jsonutil"
 	"openpitrix.io/openpitrix/pkg/util/yamlutil"
 )
@@ -26,6 +35,22 @@ func ConvertJsonToYaml(data []byte) ([]byte, error) {
 	return rawVals, nil
 }
 
+// newDetailedError reports all the causes in one error with a detail for every cause
+func newDetailedError(ctx context.Context, code codes.Code, errMsg gerr.ErrorMessage, causes []string) error {
+	err := gerr.NewWithDetail(ctx, code, errors.New(strings.Join(causes, "; ")), errMsg)
+
+	s := err.GRPCStatus()
+	for _, cause := range causes {
+		sd, e := s.WithDetails(&pb.ErrorDetail{ErrorName: errMsg.Name, Cause: cause})
+		if e != nil {
+			logger.Error(ctx, "Add detail [%s] of error failed: %+v", cause, e)
+			return err
+		}
+		s = sd
+	}
+	return s.Err()
+}
+
 func GetLabelString(m map[string]string) string {
 	b := new(bytes.Buffer)
 	for k, v := range m {
@@ -45,3 +70,80 @@ func GetStringFromValues(vals map[string]interface{}, key string) (string, bool)
 	}
 	return s, true
 }
+
+func GetBoolFromValues(vals map[string]interface{}, key string) (bool, bool) {
+	v, ok := vals[key]
+	if !ok {
+		return false, false
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, false
+	}
+	return b, true
+}
+
+// GetIntFromValues returns the integer of key, which can be either a json number or a string of digits
+func GetIntFromValues(vals map[string]interface{}, key string) (int, bool) {
+	v, ok := vals[key]
+	if !ok {
+		return 0, false
+	}
+	switch i := v.(type) {
+	case float64:
+		if i != float64(int(i)) {
+			return 0, false
+		}
+		return int(i), true
+	case int:
+		return i, true
+	case string:
+		n, err := strconv.Atoi(i)
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// MergeValues merges src into dest recursively, values from src take precedence
+func MergeValues(dest map[string]interface{}, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		// If the key doesn't exist already, then just set the key to that value
+		if _, exists := dest[k]; !exists {
+			dest[k] = v
+			continue
+		}
+		nextMap, ok := v.(map[string]interface{})
+		// If it isn't another map, overwrite the value
+		if !ok {
+			dest[k] = v
+			continue
+		}
+		// Edge case: If the key exists in the destination, but isn't a map
+		destMap, isMap := dest[k].(map[string]interface{})
+		// If the source map has a map for this key, prefer it
+		if !isMap {
+			dest[k] = v
+			continue
+		}
+		// If we got to this point, it is a map in both, so merge them
+		dest[k] = MergeValues(destMap, nextMap)
+	}
+	return dest
+}
+
+// CopyValues returns a deep copy of the nested maps in vals
+func CopyValues(vals map[string]interface{}) map[string]interface{} {
+	dest := make(map[string]interface{}, len(vals))
+	for k, v := range vals {
+		if m, ok := v.(map[string]interface{}); ok {
+			dest[k] = CopyValues(m)
+		} else {
+			dest[k] = v
+		}
+	}
+	return dest
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 The OpenPitrix Authors. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package runtime_provider
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"openpitrix.io/openpitrix/pkg/models"
+	"openpitrix.io/openpitrix/pkg/util/funcutil"
+	"openpitrix.io/openpitrix/pkg/util/jsonutil"
+)
+
+const (
+	// StoppedReplicasAnnotationKey records the replicas of a stopped deployment or statefulset
+	StoppedReplicasAnnotationKey = "openpitrix.io/stopped-replicas"
+	// StoppedNodeSelectorAnnotationKey records the node selector of a stopped daemonset
+	StoppedNodeSelectorAnnotationKey = "openpitrix.io/stopped-node-selector"
+	// StoppedNodeSelectorKey is the node selector matching no node, which suspends a stopped daemonset
+	StoppedNodeSelectorKey = "openpitrix.io/stopped"
+)
+
+// stopReplicas records the replicas in the annotations and scales them to zero, false if already stopped
+func stopReplicas(meta *metav1.ObjectMeta, replicas **int32) bool {
+	if _, ok := meta.Annotations[StoppedReplicasAnnotationKey]; ok {
+		return false
+	}
+
+	var n int32 = 1
+	if *replicas != nil {
+		n = **replicas
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	meta.Annotations[StoppedReplicasAnnotationKey] = strconv.Itoa(int(n))
+
+	var zero int32
+	*replicas = &zero
+	return true
+}
+
+// startReplicas restores the replicas recorded in the annotations, false if not stopped
+func startReplicas(meta *metav1.ObjectMeta, replicas **int32) (bool, error) {
+	recorded, ok := meta.Annotations[StoppedReplicasAnnotationKey]
+	if !ok {
+		return false, nil
+	}
+
+	n, err := strconv.Atoi(recorded)
+	if err != nil {
+		return false, err
+	}
+	r := int32(n)
+	*replicas = &r
+	delete(meta.Annotations, StoppedReplicasAnnotationKey)
+	return true, nil
+}
+
+// stopDaemonSet records the node selector in the annotations and replaces it by one matching no node
+func stopDaemonSet(daemonSet *appsv1.DaemonSet) bool {
+	if _, ok := daemonSet.Annotations[StoppedNodeSelectorAnnotationKey]; ok {
+		return false
+	}
+
+	if daemonSet.Annotations == nil {
+		daemonSet.Annotations = make(map[string]string)
+	}
+	daemonSet.Annotations[StoppedNodeSelectorAnnotationKey] = jsonutil.ToString(daemonSet.Spec.Template.Spec.NodeSelector)
+	daemonSet.Spec.Template.Spec.NodeSelector = map[string]string{StoppedNodeSelectorKey: "true"}
+	return true
+}
+
+// startDaemonSet restores the node selector recorded in the annotations, false if not stopped
+func startDaemonSet(daemonSet *appsv1.DaemonSet) (bool, error) {
+	recorded, ok := daemonSet.Annotations[StoppedNodeSelectorAnnotationKey]
+	if !ok {
+		return false, nil
+	}
+
+	var nodeSelector map[string]string
+	err := jsonutil.Decode([]byte(recorded), &nodeSelector)
+	if err != nil {
+		return false, err
+	}
+	daemonSet.Spec.Template.Spec.NodeSelector = nodeSelector
+	delete(daemonSet.Annotations, StoppedNodeSelectorAnnotationKey)
+	return true, nil
+}
+
+// StopWorkloads scales the deployments and statefulsets of the cluster roles to zero and suspends the daemonsets
+func (p *KubeHandler) StopWorkloads(namespace string, clusterRoles map[string]*models.ClusterRole) error {
+	return p.updateWorkloads(namespace, clusterRoles, true)
+}
+
+// StartWorkloads restores the workloads of the cluster roles stopped by StopWorkloads
+func (p *KubeHandler) StartWorkloads(namespace string, clusterRoles map[string]*models.ClusterRole) error {
+	return p.updateWorkloads(namespace, clusterRoles, false)
+}
+
+func (p *KubeHandler) updateWorkloads(namespace string, clusterRoles map[string]*models.ClusterRole, stop bool) error {
+	kubeClient, _, err := p.initKubeClient()
+	if err != nil {
+		return err
+	}
+	appsClient := kubeClient.AppsV1()
+
+	for _, clusterRole := range clusterRoles {
+		switch {
+		case strings.HasSuffix(clusterRole.Role, DeploymentFlag):
+			deployment, err := appsClient.Deployments(namespace).Get(strings.TrimSuffix(clusterRole.Role, DeploymentFlag), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+
+			changed := true
+			if stop {
+				changed = stopReplicas(&deployment.ObjectMeta, &deployment.Spec.Replicas)
+			} else if changed, err = startReplicas(&deployment.ObjectMeta, &deployment.Spec.Replicas); err != nil {
+				return err
+			}
+			if changed {
+				_, err = appsClient.Deployments(namespace).Update(deployment)
+				if err != nil {
+					return err
+				}
+			}
+		case strings.HasSuffix(clusterRole.Role, StatefulSetFlag):
+			statefulSet, err := appsClient.StatefulSets(namespace).Get(strings.TrimSuffix(clusterRole.Role, StatefulSetFlag), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+
+			changed := true
+			if stop {
+				changed = stopReplicas(&statefulSet.ObjectMeta, &statefulSet.Spec.Replicas)
+			} else if changed, err = startReplicas(&statefulSet.ObjectMeta, &statefulSet.Spec.Replicas); err != nil {
+				return err
+			}
+			if changed {
+				_, err = appsClient.StatefulSets(namespace).Update(statefulSet)
+				if err != nil {
+					return err
+				}
+			}
+		case strings.HasSuffix(clusterRole.Role, DaemonSetFlag):
+			daemonSet, err := appsClient.DaemonSets(namespace).Get(strings.TrimSuffix(clusterRole.Role, DaemonSetFlag), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+
+			changed := true
+			if stop {
+				changed = stopDaemonSet(daemonSet)
+			} else if changed, err = startDaemonSet(daemonSet); err != nil {
+				return err
+			}
+			if changed {
+				_, err = appsClient.DaemonSets(namespace).Update(daemonSet)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isWorkloadStopped returns whether the workload of the cluster role is stopped by StopWorkloads
+func (p *KubeHandler) isWorkloadStopped(namespace string, clusterRole *models.ClusterRole) (bool, error) {
+	kubeClient, _, err := p.initKubeClient()
+	if err != nil {
+		return false, err
+	}
+	appsClient := kubeClient.AppsV1()
+
+	var annotations map[string]string
+	switch {
+	case strings.HasSuffix(clusterRole.Role, DeploymentFlag):
+		deployment, err := appsClient.Deployments(namespace).Get(strings.TrimSuffix(clusterRole.Role, DeploymentFlag), metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		annotations = deployment.Annotations
+	case strings.HasSuffix(clusterRole.Role, StatefulSetFlag):
+		statefulSet, err := appsClient.StatefulSets(namespace).Get(strings.TrimSuffix(clusterRole.Role, StatefulSetFlag), metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		annotations = statefulSet.Annotations
+	case strings.HasSuffix(clusterRole.Role, DaemonSetFlag):
+		daemonSet, err := appsClient.DaemonSets(namespace).Get(strings.TrimSuffix(clusterRole.Role, DaemonSetFlag), metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		_, ok := daemonSet.Annotations[StoppedNodeSelectorAnnotationKey]
+		return ok, nil
+	default:
+		return false, nil
+	}
+	_, ok := annotations[StoppedReplicasAnnotationKey]
+	return ok, nil
+}
+
+// isWorkloadReady returns whether all the desired pods of the workload of the cluster role are ready
+func (p *KubeHandler) isWorkloadReady(namespace string, clusterRole *models.ClusterRole) (bool, error) {
+	kubeClient, _, err := p.initKubeClient()
+	if err != nil {
+		return false, err
+	}
+	appsClient := kubeClient.AppsV1()
+
+	switch {
+	case strings.HasSuffix(clusterRole.Role, DeploymentFlag):
+		deployment, err := appsClient.Deployments(namespace).Get(strings.TrimSuffix(clusterRole.Role, DeploymentFlag), metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		var replicas int32 = 1
+		if deployment.Spec.Replicas != nil {
+			replicas = *deployment.Spec.Replicas
+		}
+		return deployment.Status.ObservedGeneration >= deployment.Generation &&
+			deployment.Status.UpdatedReplicas == replicas && deployment.Status.ReadyReplicas == replicas, nil
+	case strings.HasSuffix(clusterRole.Role, StatefulSetFlag):
+		statefulSet, err := appsClient.StatefulSets(namespace).Get(strings.TrimSuffix(clusterRole.Role, StatefulSetFlag), metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		var replicas int32 = 1
+		if statefulSet.Spec.Replicas != nil {
+			replicas = *statefulSet.Spec.Replicas
+		}
+		return statefulSet.Status.ObservedGeneration >= statefulSet.Generation && statefulSet.Status.ReadyReplicas == replicas, nil
+	case strings.HasSuffix(clusterRole.Role, DaemonSetFlag):
+		daemonSet, err := appsClient.DaemonSets(namespace).Get(strings.TrimSuffix(clusterRole.Role, DaemonSetFlag), metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return daemonSet.Status.ObservedGeneration >= daemonSet.Generation &&
+			daemonSet.Status.NumberReady == daemonSet.Status.DesiredNumberScheduled, nil
+	}
+	return true, nil
+}
+
+// WaitWorkloadStopped waits until the pods of the stopped cluster roles are gone
+func (p *KubeHandler) WaitWorkloadStopped(namespace string, clusterRoles map[string]*models.ClusterRole, timeout time.Duration, waitInterval time.Duration) error {
+	return funcutil.WaitForSpecificOrError(func() (bool, error) {
+		for _, clusterRole := range clusterRoles {
+			pods, err := p.getPodsByClusterRole(namespace, clusterRole)
+			if err != nil {
+				return true, err
+			}
+			if pods != nil && len(pods.Items) > 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, timeout, waitInterval)
+}
+
+// WaitWorkloadStarted waits until the pods of the started cluster roles are ready
+func (p *KubeHandler) WaitWorkloadStarted(namespace string, clusterRoles map[string]*models.ClusterRole, timeout time.Duration, waitInterval time.Duration) error {
+	return funcutil.WaitForSpecificOrError(func() (bool, error) {
+		for _, clusterRole := range clusterRoles {
+			ready, err := p.isWorkloadReady(namespace, clusterRole)
+			if err != nil {
+				return true, err
+			}
+			if !ready {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, timeout, waitInterval)
+}